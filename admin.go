@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+/**
+Admin endpoints let operators drop entries from the cache by hand, for example after fixing bad data in Redis, rather
+than restarting the proxy. They are only served if an admin token is configured, and every request must carry it in
+an "Authorization: Bearer <token>" header.
+  DELETE /admin/keys/<key>            purges the key, addressed as for reads, encoding=base64 included
+  DELETE /admin/keys?prefix=<prefix>  purges all keys starting with the prefix
+  DELETE /admin/keys?pattern=<glob>   purges all keys matching the glob pattern, in Redis KEYS syntax
+  DELETE /admin/keys?all              purges the whole cache
+Each responds with a JSON object counting the entries dropped, such as {"purged": 12}. Purges only drop entries from
+the cache, never keys from Redis, and are passed on to other proxies over the invalidation bus, if there is one.
+Read-only endpoints for inspecting the cache are in inspect.go.
+ */
+
+// Wraps an admin handler to require the token as a bearer token, responding with 401 Unauthorized otherwise.
+func requireAdminToken(token string, handler http.HandlerFunc) http.HandlerFunc {
+	expected := []byte("Bearer " + token)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="redisproxy admin"`)
+			http.Error(w, "missing or invalid admin token", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// Handles DELETE requests for a single key, purging it from the cache.
+func (cache *cache) PurgeKey(w http.ResponseWriter, r *http.Request) {
+	key, err := requestKey(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writePurged(w, cache.purgeKey(key))
+}
+
+// Handles DELETE requests for many keys, purging those matching the prefix or pattern in the query, or all of them.
+func (cache *cache) PurgeKeys(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	_, all := query["all"]
+	prefix, isPrefix := query["prefix"]
+	pattern, isPattern := query["pattern"]
+
+	switch {
+	case all && !isPrefix && !isPattern:
+		writePurged(w, cache.purgeAll())
+	case isPrefix && !all && !isPattern:
+		decoded, err := decodeKey(prefix[0], query.Get("encoding"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writePurged(w, cache.purgeMatching(globEscape(decoded)+"*"))
+	case isPattern && !all && !isPrefix:
+		writePurged(w, cache.purgeMatching(pattern[0]))
+	default:
+		http.Error(w, "expected one of prefix, pattern or all", http.StatusBadRequest)
+	}
+}
+
+func writePurged(w http.ResponseWriter, purged int) {
+	writeJSON(w, map[string]int{"purged": purged})
+}
+
+// Removes the key from the cache, and from other proxies' over the bus. Returns the number of entries removed.
+func (cache *cache) purgeKey(key string) int {
+	purged := 0
+	if cache.invalidate(key) {
+		purged = 1
+	}
+	cache.publishInvalidation([]string{key})
+	return purged
+}
+
+// Removes all keys matching the glob pattern from the cache, and from other proxies' over the bus. Returns the number
+// of entries removed.
+func (cache *cache) purgeMatching(pattern string) int {
+	purged := cache.removeMatching(pattern)
+	if cache.bus != nil {
+		cache.bus.publishPattern(pattern)
+	}
+	return purged
+}
+
+// Empties the cache, and other proxies' over the bus. Returns the number of entries removed.
+func (cache *cache) purgeAll() int {
+	purged := cache.removeAll()
+	if cache.bus != nil {
+		cache.bus.publishAll()
+	}
+	return purged
+}
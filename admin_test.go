@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Checks that admin endpoints require the token, and are not served at all without one configured.
+func TestAdminEndpointsRequireToken(t *testing.T) {
+	cache := newPolicyTestCache(10, newLRUPolicy)
+	readThrough(cache.shards[0], "k")
+
+	for _, token := range []string{"", "wrong", "secret "} {
+		var headers []string
+		if token != "" {
+			headers = []string{"Authorization", "Bearer " + token}
+		}
+		res := routeRequest(cache, "DELETE", "/admin/keys?all", "", headers...)
+		if res.Code != http.StatusUnauthorized {
+			t.Errorf("Expected token %q to be refused, got %d", token, res.Code)
+		}
+	}
+	if !cacheHoldsKey(cache.shards[0], "k") {
+		t.Errorf("Expected refused requests not to purge anything")
+	}
+
+	req := httptest.NewRequest("DELETE", "/admin/keys?all", nil)
+	res := httptest.NewRecorder()
+	newRouter(cache, "").ServeHTTP(res, req)
+	if res.Code != http.StatusNotFound {
+		t.Errorf("Expected admin endpoints not to be served without a token configured, got %d", res.Code)
+	}
+}
+
+// Checks that keys can be purged one at a time, by prefix, by pattern and all at once, with the number purged reported.
+func TestAdminPurgesKeys(t *testing.T) {
+	cache := newPolicyTestCache(10, newLRUPolicy)
+	for _, key := range []string{"user:1", "user:2", "user*:3", "feed:1", "feed:22", "binary:\xff", "other"} {
+		readThrough(cache.shards[0], key)
+	}
+
+	purges := []struct {
+		target   string
+		expected string
+		removed  []string
+	}{
+		{"/admin/keys/user:1", `{"purged":1}`, []string{"user:1"}},
+		{"/admin/keys/user:1", `{"purged":0}`, nil},
+		{"/admin/keys/YmluYXJ5Ov8=?encoding=base64", `{"purged":1}`, []string{"binary:\xff"}},
+		{"/admin/keys?prefix=user*", `{"purged":1}`, []string{"user*:3"}},
+		{"/admin/keys?pattern=feed:?", `{"purged":1}`, []string{"feed:1"}},
+		{"/admin/keys?all", `{"purged":3}`, []string{"user:2", "feed:22", "other"}},
+	}
+	for _, purge := range purges {
+		res := routeRequest(cache, "DELETE", purge.target, "", adminAuthorization...)
+		if res.Code != http.StatusOK || res.Body.String() != purge.expected+"\n" {
+			t.Errorf("For %s, expected %s, got %d %q", purge.target, purge.expected, res.Code, res.Body.String())
+		}
+		for _, key := range purge.removed {
+			if cacheHoldsKey(cache.shards[0], key) {
+				t.Errorf("For %s, expected %q to be purged", purge.target, key)
+			}
+		}
+	}
+	checkListMatchesMap(t, cache)
+}
+
+// Checks that purges of many keys must say which keys.
+func TestAdminPurgeRequiresOneSelector(t *testing.T) {
+	cache := newPolicyTestCache(10, newLRUPolicy)
+	for _, target := range []string{"/admin/keys", "/admin/keys?all&prefix=a", "/admin/keys?prefix=a&pattern=b*"} {
+		if res := routeRequest(cache, "DELETE", target, "", adminAuthorization...); res.Code != http.StatusBadRequest {
+			t.Errorf("For %s, expected 400 Bad Request, got %d", target, res.Code)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+// Adaptive Replacement Cache (Megiddo and Modha). Entries read once live in t1 and entries read again in t2, while b1
+// and b2 remember the keys recently evicted from each. A miss on a key in b1 means t1 was too small, and grows its
+// target size p; a miss on a key in b2 shrinks it. A scan of keys read once only ever displaces other entries of t1.
+type arcPolicy struct {
+	capacity int
+	p        int // Target size of t1.
+	t1, t2   nodeList
+	b1, b2   *ghostList
+	// Whether the last added key was found in b2, which makes a tie on p evict from t1.
+	lastInB2 bool
+}
+
+// Which of an ARC policy's lists a node is in.
+const (
+	arcT1 = iota
+	arcT2
+)
+
+func newARCPolicy(capacity int) evictionPolicy {
+	return &arcPolicy{capacity: capacity, b1: newGhostList(), b2: newGhostList()}
+}
+
+func (policy *arcPolicy) add(n *node) {
+	policy.lastInB2 = false
+	switch {
+	case policy.b1.contains(n.key):
+		policy.p = minInt(policy.capacity, policy.p+maxInt(policy.b2.len()/policy.b1.len(), 1))
+		policy.b1.remove(n.key)
+		n.queue = arcT2
+		policy.t2.insertNodeAtListFront(n)
+	case policy.b2.contains(n.key):
+		policy.p = maxInt(0, policy.p-maxInt(policy.b1.len()/policy.b2.len(), 1))
+		policy.b2.remove(n.key)
+		policy.lastInB2 = true
+		n.queue = arcT2
+		policy.t2.insertNodeAtListFront(n)
+	default:
+		n.queue = arcT1
+		policy.t1.insertNodeAtListFront(n)
+	}
+
+	// Keep the ghosts to at most the capacity for t1 and b1, and twice the capacity across all four lists.
+	policy.b1.trimTo(maxInt(0, policy.capacity-policy.t1.len))
+	policy.b2.trimTo(maxInt(0, 2*policy.capacity-policy.t1.len-policy.t2.len-policy.b1.len()))
+}
+
+func (policy *arcPolicy) touch(n *node) {
+	policy.list(n).removeNodeFromList(n)
+	n.queue = arcT2
+	policy.t2.insertNodeAtListFront(n)
+}
+
+func (policy *arcPolicy) remove(n *node) {
+	policy.list(n).removeNodeFromList(n)
+}
+
+func (policy *arcPolicy) evict() *node {
+	t1 := policy.t1.len
+	if t1 > 0 && (t1 > policy.p || (policy.lastInB2 && t1 == policy.p) || policy.t2.len == 0) {
+		victim := policy.t1.removeNodeFromList(policy.t1.tail)
+		policy.b1.push(victim.key)
+		return victim
+	}
+
+	victim := policy.t2.removeNodeFromList(policy.t2.tail)
+	policy.b2.push(victim.key)
+	return victim
+}
+
+func (policy *arcPolicy) each(fn func(n *node) bool) {
+	if policy.t2.each(fn) {
+		policy.t1.each(fn)
+	}
+}
+
+func (policy *arcPolicy) list(n *node) *nodeList {
+	if n.queue == arcT2 {
+		return &policy.t2
+	}
+	return &policy.t1
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gomodule/redigo/redis"
+	"net/http"
+	"sync/atomic"
+)
+
+/**
+Batch lookups serve many keys in one request, for pages that need dozens of them. Keys found in the cache are served
+from it, and all the others are fetched from Redis together, with a single MGET pipelined with their PTTLs, in one
+round trip however many keys missed. The fetched values are cached just as single lookups would cache them.
+ */
+
+const (
+	maxBatchKeys      = 1000
+	maxBatchBodyBytes = 1 << 20
+)
+
+// Handles POST requests for several keys at once. The body is a JSON array of keys, and the response a JSON object
+// mapping each key to its value, or to null if the key does not exist in Redis or does not hold a string. With an
+// encoding query parameter, keys are decoded as in keys.go, and the response maps them as they were sent.
+func (cache *cache) GetValues(w http.ResponseWriter, r *http.Request) {
+	var sentKeys []string
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchBodyBytes)).Decode(&sentKeys); err != nil {
+		http.Error(w, "body must be a JSON array of keys", http.StatusBadRequest)
+		return
+	}
+
+	if len(sentKeys) > maxBatchKeys {
+		http.Error(w, "too many keys", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	keys := make([]string, len(sentKeys))
+	for i, sentKey := range sentKeys {
+		key, err := decodeKey(sentKey, r.URL.Query().Get("encoding"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		keys[i] = key
+	}
+
+	values, err := cache.getMany(keys)
+	if err != nil {
+		http.Error(w, err.Error(), backendErrorStatus(err))
+		return
+	}
+
+	response := make(map[string]*string, len(values))
+	for i, key := range keys {
+		response[sentKeys[i]] = values[key]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// Looks up several keys, serving those that are cached from the cache and fetching the rest from Redis in one round
+// trip. Returns each key's value, or nil if it does not exist in Redis or does not hold a string. If Redis fails, the
+// keys that missed are served from their stale-if-error values if they all have one, and the error is returned
+// otherwise.
+func (cache *cache) getMany(keys []string) (map[string]*string, error) {
+	values := make(map[string]*string, len(keys))
+	requested := make(map[string]bool, len(keys))
+	var misses []string
+	for _, key := range keys {
+		if requested[key] {
+			continue
+		}
+		requested[key] = true
+
+		if cache.cacheable(key) {
+			value, status := cache.fetchFromCache(key)
+			if status == statusHit || status == statusStale {
+				atomic.AddInt64(&cache.stats.Hits, 1)
+				values[key] = &value
+				continue
+			}
+
+			if status == statusNotFound {
+				atomic.AddInt64(&cache.stats.Hits, 1)
+				values[key] = nil
+				continue
+			}
+		}
+		atomic.AddInt64(&cache.stats.Misses, 1)
+
+		if value, ok := cache.pendingWrite(key); ok {
+			values[key] = &value
+			continue
+		}
+		misses = append(misses, key)
+	}
+
+	if len(misses) == 0 {
+		return values, nil
+	}
+
+	if err := cache.fetchManyFromRedis(misses, values); err != nil {
+		for _, key := range misses {
+			value, ok := cache.shardFor(key).fetchStaleIfError(key)
+			if !ok {
+				return nil, err
+			}
+			values[key] = &value
+		}
+	}
+	return values, nil
+}
+
+// Fetches the keys from Redis with MGET, along with their PTTLs, stores their values in the cache and adds them to
+// values. MGET replies nil both for missing keys and for keys holding other types; only keys whose PTTL shows them to
+// be missing are cached as missing.
+func (cache *cache) fetchManyFromRedis(keys []string, values map[string]*string) error {
+	versions := make([]uint64, len(keys))
+	for i, key := range keys {
+		versions[i] = cache.shardFor(key).begin(key)
+	}
+
+	// Keys are filled in order; if Redis fails, the fetches of those not filled yet end here.
+	filled := 0
+	defer func() {
+		for _, key := range keys[filled:] {
+			cache.shardFor(key).abandon(key)
+		}
+	}()
+
+	conn := cache.pool.Get()
+	defer conn.Close()
+
+	conn.Send("MGET", redis.Args{}.AddFlat(keys)...)
+	for _, key := range keys {
+		conn.Send("PTTL", key)
+	}
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+
+	replies, err := redis.Values(conn.Receive())
+	if err != nil {
+		return err
+	}
+
+	for i, key := range keys {
+		pttl, pttlErr := redis.Int64(conn.Receive())
+		if replies[i] == nil {
+			values[key] = nil
+			var n *node
+			if pttlErr == nil && pttl == -2 {
+				n = cache.negativeNodeFor(key)
+			}
+			cache.shardFor(key).fill(key, n, versions[i])
+			filled++
+			continue
+		}
+
+		value, err := redis.String(replies[i], nil)
+		if err != nil {
+			return err
+		}
+		values[key] = &value
+		cache.storeFetched(key, value, pttl, pttlErr, versions[i])
+		filled++
+	}
+	return nil
+}
@@ -1,193 +1,572 @@
 package main
 
 import (
-	"bytes"
-	"fmt"
 	"github.com/gomodule/redigo/redis"
 	"log"
 	"net/http"
+	"sync/atomic"
 	"time"
 )
 
-// Linked list nodes.
+// Linked list nodes. A negative node records that the key does not exist in Redis, and has no value. segment is the
+// index of the shard segment holding the node. queue and freq are bookkeeping for the segment's eviction policy.
+// Past expiresAt, the value may still be served while it is revalidated until staleUntil, and while Redis is failing
+// until staleIfErrorUntil (see stale.go). Past refreshAt, unless it is zero, a value read often enough is refreshed
+// ahead of expiring (see refresh.go). hits counts reads since the node was cached. written is true if the value was
+// written through the proxy, rather than fetched from Redis.
 type node struct {
-	prev, next *node
-	key, value string
-	creationTime time.Time
+	prev, next        *node
+	key, value        string
+	negative          bool
+	written           bool
+	segment           int
+	queue             uint8
+	freq              int
+	refreshing        bool
+	hits              int
+	creationTime      time.Time
+	lastAccess        time.Time
+	refreshAt         time.Time
+	expiresAt         time.Time
+	staleUntil        time.Time
+	staleIfErrorUntil time.Time
 }
 
-func newNode(key, value string) *node {
+func newNode(key, value string, ttl time.Duration, segment int) *node {
 	n := new(node)
 	n.key = key
 	n.value = value
+	n.segment = segment
 	n.creationTime = time.Now()
+	n.expiresAt = n.creationTime.Add(ttl)
+	n.staleUntil = n.expiresAt
+	n.staleIfErrorUntil = n.expiresAt
+	return n
+}
+
+func newNegativeNode(key string, ttl time.Duration) *node {
+	n := newNode(key, "", ttl, negativeSegment)
+	n.negative = true
 	return n
 }
 
 // Creates a connection pool for Redis, capped at the max number of connections specified in Dockerfile.
+// When all connections are in use, callers wait for one to be returned rather than failing.
 func newPool(redisServer string, maxConnections int) *redis.Pool {
 	return &redis.Pool{
-		MaxIdle: maxConnections,
-		MaxActive: maxConnections,
+		MaxIdle:     maxConnections,
+		MaxActive:   maxConnections,
 		IdleTimeout: 60 * time.Second,
-		Dial: func () (redis.Conn, error) { return redis.Dial("tcp", redisServer) },
+		Wait:        true,
+		Dial:        func() (redis.Conn, error) { return redis.Dial("tcp", redisServer) },
 	}
 }
 
-// Contains pointers to head and tail of its linked list, a (string -> node) map keyed by entry key,
-// and a Redis connection, as well as capacity and expirationTime settings.
+// Contains the shards holding the cached entries, and a Redis connection pool, as well as the expirationTime setting.
+// Each key belongs to exactly one shard, picked by hashing the key, and capacity is divided evenly between shards.
+// The cache is safe for concurrent use: each shard has its own lock, and each Redis call borrows its own connection
+// from the pool.
 type cache struct {
-	conn redis.Conn
-	head, tail *node
-	key2ElementMap map[string]*node
-	capacity int
-	expirationTime time.Duration
+	pool                   *redis.Pool
+	shards                 []*shard
+	shardCount             int
+	expirationTime         time.Duration
+	negativeExpirationTime time.Duration
+	negativeCapacity       int
+	maxBytes               int
+	maxValueBytes          int
+	staleWhileRevalidate   time.Duration
+	staleIfError           time.Duration
+	refreshAhead           float64
+	refreshAheadHits       int
+	rules                  []cacheRule
+	newPolicy              policyFactory
+	janitor                *janitor
+	invalidation           *invalidationListener
+	bus                    *invalidationBus
+	writeBehind            *writeBehind
+	flights                flightGroup
+	stats                  cacheStats
+	metrics                metrics
+}
+
+// Optional settings for NewCache.
+type option func(*cache)
+
+// Splits the cache into n independently locked shards. With a single shard (the default), eviction is exact LRU across
+// the whole cache but every request takes the same lock; with more, LRU order is kept per shard. n is capped at the
+// capacity, so that every shard can hold at least one entry.
+func WithShards(n int) option {
+	return func(c *cache) {
+		c.shardCount = n
+	}
+}
+
+// Caches the fact that a key does not exist in Redis, for ttl, so that repeated lookups of nonexistent keys are not
+// sent to Redis each time. Negative entries are held apart from values, up to capacity of them, so that lookups of
+// random keys only ever evict other negative entries. Negative caching is disabled if capacity is zero.
+func WithNegativeCaching(ttl time.Duration, capacity int) option {
+	return func(c *cache) {
+		c.negativeExpirationTime = ttl
+		c.negativeCapacity = capacity
+	}
+}
+
+// Applies per-namespace caching policies to keys matching the rules, in order of precedence. See rules.go.
+func WithRules(rules []cacheRule) option {
+	return func(c *cache) {
+		c.rules = append([]cacheRule(nil), rules...)
+	}
+}
+
+// Limits the memory used by cached values to about maxBytes, counting each entry's key, value and bookkeeping
+// overhead. This applies alongside the capacity in entries given to NewCache; with a byte limit, a capacity of zero
+// leaves the number of entries unlimited. Like capacity, the budget is divided evenly between shards, and does not
+// cover negative entries or keys of cache rules with their own capacity.
+func WithMaxBytes(maxBytes int) option {
+	return func(c *cache) {
+		c.maxBytes = maxBytes
+	}
+}
+
+// Passes values larger than maxValueBytes through from Redis without caching them, so that a few huge values cannot
+// evict everything else.
+func WithMaxValueBytes(maxValueBytes int) option {
+	return func(c *cache) {
+		c.maxValueBytes = maxValueBytes
+	}
 }
 
-func NewCache(redisServer string, capacity int, expirationTime int, maxConnections int) *cache {
+// Picks the entries to evict when a segment is full, using one of the policies in eviction.go. The default is LRU.
+func WithEvictionPolicy(newPolicy policyFactory) option {
+	return func(c *cache) {
+		c.newPolicy = newPolicy
+	}
+}
+
+func NewCache(redisServer string, capacity int, expirationTime int, maxConnections int, options ...option) *cache {
 	c := new(cache)
-	conn, err := newPool(redisServer, maxConnections).Dial()
+	c.shardCount = 1
+	c.newPolicy = newLRUPolicy
+	for _, option := range options {
+		option(c)
+	}
+
+	c.pool = newPool(redisServer, maxConnections)
+
+	// Listeners dial connections of their own, which are neither timed nor prepared the way a source may prepare the
+	// pool's.
+	dial := c.pool.Dial
+	c.pool.Dial = c.metrics.timedDial(dial)
+
+	// Fail fast if Redis is unreachable, rather than on the first request.
+	conn := c.pool.Get()
+	_, err := conn.Do("PING")
+	conn.Close()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	c.conn = conn
-	c.key2ElementMap = make(map[string]*node)
-	c.capacity = capacity
+	if capacity > 0 && c.shardCount > capacity {
+		c.shardCount = capacity
+	}
+	if c.shardCount < 1 {
+		c.shardCount = 1
+	}
+
+	// Every shard has a segment for values and one for negative entries, plus one for each rule with its own capacity.
+	limits := []segmentLimits{
+		valuesSegment:   {entries: capacity, bytes: c.maxBytes},
+		negativeSegment: {entries: c.negativeCapacity},
+	}
+	for i := range c.rules {
+		c.rules[i].segment = valuesSegment
+		if c.rules[i].maxEntries > 0 {
+			c.rules[i].segment = len(limits)
+			limits = append(limits, segmentLimits{entries: c.rules[i].maxEntries})
+		}
+	}
+
+	c.shards = make([]*shard, c.shardCount)
+	for i := range c.shards {
+		shardLimits := make([]segmentLimits, len(limits))
+		for segment, total := range limits {
+			shardLimits[segment] = segmentLimits{
+				entries: shareOf(total.entries, c.shardCount, i),
+				bytes:   shareOf(total.bytes, c.shardCount, i),
+			}
+			// A negativeCapacity or rule's max entries below the shard count would leave some shards evicting every
+			// entry of the segment as soon as it is cached, so every shard holds at least one.
+			if total.entries > 0 && shardLimits[segment].entries == 0 {
+				shardLimits[segment].entries = 1
+			}
+		}
+		c.shards[i] = newShard(shardLimits, c.newPolicy)
+		c.shards[i].refreshAheadHits = c.refreshAheadHits
+	}
+
 	c.expirationTime = time.Duration(expirationTime) * time.Second
+	if c.janitor != nil {
+		c.janitor.start(c)
+	}
+	if c.writeBehind != nil {
+		c.writeBehind.start(c.pool, c.publishInvalidation)
+	}
+
+	if c.invalidation != nil {
+		c.invalidation.start(c, dial)
+	}
+	if c.bus != nil {
+		c.bus.start(c, dial)
+	}
 	return c
 }
 
+// Returns shard i's share of a total spread evenly across n shards, giving the remainder to the first shards.
+func shareOf(total, n, i int) int {
+	share := total / n
+	if i < total%n {
+		share++
+	}
+	return share
+}
+
+// Stops the janitor and invalidation listeners, if any, flushes writes waiting to be written behind, and closes the
+// connection pool. Connections borrowed by in-flight requests are closed as they are returned.
 func (cache *cache) Close() {
-	cache.conn.Close()
+	if cache.invalidation != nil {
+		cache.invalidation.shutdown()
+	}
+	if cache.bus != nil {
+		cache.bus.shutdown()
+	}
+	if cache.janitor != nil {
+		cache.janitor.shutdown()
+	}
+	if cache.writeBehind != nil {
+		cache.writeBehind.shutdown()
+	}
+	cache.pool.Close()
 }
 
 func (cache *cache) GetSize() int {
-	return len(cache.key2ElementMap)
+	size := 0
+	for _, shard := range cache.shards {
+		size += shard.size()
+	}
+	return size
 }
 
-// This is the function that is attached to our HTTP service. It just parses the request header to get the
-// requested key, and sends this off to our get() method. The resulting value is written as an HTTP response.
-// Uncomment the logContents() call to see the cache contents after each call to GetValue(). Note, these log statements
-// may not show up in terminal if the application is run with Docker.
-func (cache *cache) GetValue(w http.ResponseWriter, r *http.Request) {
-	key := r.Header.Get("key")
-	value, _ := cache.get(key)
-	fmt.Fprint(w, string(value))
-	//cache.logContents()
+// Returns the approximate memory used by cached entries, in bytes.
+func (cache *cache) GetBytes() int {
+	bytes := 0
+	for _, shard := range cache.shards {
+		bytes += shard.bytes()
+	}
+	return bytes
 }
 
+// This is the function that is attached to our HTTP service. It just parses the request path, query or header to get
+// the requested key (see keys.go), and sends this off to our get() method. The resulting value is written as the HTTP response body,
+// byte for byte. Keys missing from Redis get a 404, and Redis failures a 502 or 503 (see backendErrorStatus()).
+// The X-Cache response header tells whether the value was served from the cache (HIT) or from Redis (MISS). To see what
+// the cache holds, use the admin endpoints in inspect.go.
+func (cache *cache) GetValue(w http.ResponseWriter, r *http.Request) {
+	key, err := requestKey(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-// Tries to fetch the value from the cache, otherwise fetches it from Redis.
-func (cache *cache) get(key string) (value string, fetchedFromRedis bool) {
-	value = cache.fetchFromCache(key)
-	if value == "" || value == "E" {
-		return cache.fetchFromRedis(key), true
-	} else {
-		return value, false
+	if key == "" {
+		http.Error(w, "missing key", http.StatusBadRequest)
+		return
+	}
+
+	value, status, err := cache.get(key)
+	switch status {
+	case statusNotFound:
+		http.Error(w, "key not found", http.StatusNotFound)
+	case statusError:
+		http.Error(w, err.Error(), backendErrorStatus(err))
+	default:
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("X-Cache", status.String())
+		w.Write([]byte(value))
 	}
 }
 
-// Fetches a value from Redis. If the key is not present, returns an empty string.
-func (cache *cache) fetchFromRedis(key string) string {
-	var data []byte
-	data, err := redis.Bytes(cache.conn.Do("GET", key))
-	if err != nil {
-		return ""
-	} else {
-		value := string(data)
-		cache.putInCache(key, value)
-		return value
+// Maps a Redis failure to an HTTP status: 502 Bad Gateway if Redis answered with an error reply, such as WRONGTYPE for
+// a key holding a list, and 503 Service Unavailable if Redis could not be reached at all.
+func backendErrorStatus(err error) int {
+	if _, ok := err.(redis.Error); ok {
+		return http.StatusBadGateway
 	}
+	return http.StatusServiceUnavailable
+}
+
+// Outcome of looking a key up through the cache.
+type lookupStatus int
 
+const (
+	statusHit      lookupStatus = iota // Served from the cache.
+	statusMiss                         // Not in the cache, fetched from Redis.
+	statusNotFound                     // The key does not exist in Redis.
+	statusError                        // Redis could not be reached, or replied with an error.
+	statusStale                        // Served from the cache after expiring, see stale.go.
+)
+
+func (status lookupStatus) String() string {
+	switch status {
+	case statusHit:
+		return "HIT"
+	case statusMiss:
+		return "MISS"
+	case statusNotFound:
+		return "NOT_FOUND"
+	case statusStale:
+		return "STALE"
+	default:
+		return "ERROR"
+	}
 }
 
-// Returns the value if found in the cache, "E" if found in the cache but expired, and an empty string if not found.
-func (cache *cache) fetchFromCache(key string) string {
-	if foundNode, ok := cache.key2ElementMap[key]; ok {
-		elapsed := time.Now().Sub(foundNode.creationTime)
-		if elapsed > cache.expirationTime {
-			cache.removeKey(key)
-			return "E"
+// Tries to fetch the value from the cache, otherwise fetches it from Redis. Concurrent misses for the same key share
+// a single fetch from Redis. An expired value within its stale windows is served rather than the error if Redis
+// fails, and served right away, while it is refreshed in the background, within its revalidation window. err is only
+// set when status is statusError.
+func (cache *cache) get(key string) (value string, status lookupStatus, err error) {
+	if cache.cacheable(key) {
+		if value, status := cache.fetchFromCache(key); status != statusMiss {
+			atomic.AddInt64(&cache.stats.Hits, 1)
+			return value, status, nil
 		}
+	}
+	atomic.AddInt64(&cache.stats.Misses, 1)
 
-		cache.removeNodeFromList(foundNode)
-		cache.insertNodeAtListFront(foundNode)
-		return foundNode.value
-	} else {
-		return ""
+	value, err, shared := cache.flights.do(key, func() (string, error) {
+		return cache.fetchFromRedis(key)
+	})
+	if shared {
+		atomic.AddInt64(&cache.stats.Coalesced, 1)
+	}
+
+	switch err {
+	case nil:
+		return value, statusMiss, nil
+	case redis.ErrNil:
+		return "", statusNotFound, nil
+	default:
+		if value, ok := cache.shardFor(key).fetchStaleIfError(key); ok {
+			return value, statusStale, nil
+		}
+		return "", statusError, err
 	}
 }
 
-// Places a key value pairing in the cache by creating a node, inserting it at the front of the linked list,
-// and mapping the key to the new node in key2ElementMap.
-func (cache *cache) putInCache(key, value string) {
-	if key == "" {
-		return
+// Returns the value of a write of the key that has not been flushed to Redis yet, in write-behind mode.
+func (cache *cache) pendingWrite(key string) (string, bool) {
+	if cache.writeBehind == nil {
+		return "", false
+	}
+	return cache.writeBehind.lookup(key)
+}
+
+// Fetches a value from Redis and stores it in the cache. If the key is not present, returns redis.ErrNil, and caches
+// that fact if negative caching is enabled. The key's remaining TTL is fetched in the same round trip, so that the
+// value is not served from the cache after Redis has expired it. A write of the key still waiting to be written
+// behind is returned instead, as Redis does not have it yet.
+func (cache *cache) fetchFromRedis(key string) (string, error) {
+	shard := cache.shardFor(key)
+	version := shard.begin(key)
+	if value, ok := cache.pendingWrite(key); ok {
+		shard.abandon(key)
+		return value, nil
 	}
 
-	newNode := newNode(key, value)
-	cache.insertNodeAtListFront(newNode)
-	cache.key2ElementMap[key] = newNode
+	conn := cache.pool.Get()
+	defer conn.Close()
 
-	if len(cache.key2ElementMap) > cache.capacity {
-		lastNode := cache.tail
-		if lastNode != nil {
-			cache.removeKey(lastNode.key)
-		}
+	conn.Send("GET", key)
+	conn.Send("PTTL", key)
+	if err := conn.Flush(); err != nil {
+		shard.abandon(key)
+		return "", err
 	}
+
+	value, err := redis.String(conn.Receive())
+	pttl, pttlErr := redis.Int64(conn.Receive())
+	switch err {
+	case nil:
+		cache.storeFetched(key, value, pttl, pttlErr, version)
+		return value, nil
+	case redis.ErrNil:
+		// Also drops any expired value still held to be served stale.
+		shard.fill(key, cache.negativeNodeFor(key), version)
+	default:
+		shard.abandon(key)
+	}
+	return "", err
 }
 
-// Removes all trace of the key value pairing associated with the input key. Removes from both linked list and map.
-func (cache *cache) removeKey(key string) {
-	targetNode := cache.key2ElementMap[key]
-	cache.removeNodeFromList(targetNode)
-	delete(cache.key2ElementMap, key)
+// Caches a value fetched from Redis, given the key's PTTL fetched along with it, unless the key was written since the
+// fetch began at version. If the value cannot be cached, any expired value still held for the key is dropped.
+func (cache *cache) storeFetched(key, value string, pttl int64, pttlErr error, version uint64) {
+	var n *node
+	if ttl, cacheable := cache.ttlFor(key, pttl); pttlErr == nil && cacheable {
+		n = cache.valueNodeFor(key, value, ttl)
+	}
+	cache.shardFor(key).fill(key, n, version)
 }
 
-// Inserts a linked list node at the start of the list.
-func (cache *cache) insertNodeAtListFront(newNode *node) {
-	newNode.prev = nil
-	newNode.next = cache.head
-	if newNode.next != nil {
-		newNode.next.prev = newNode
+// Returns how long a value fetched from Redis may be cached, given the key's PTTL in milliseconds: the expiration
+// time for the key, cut short if Redis expires the key sooner. A PTTL of -1 means the key never expires. Returns false
+// if the key is already gone from Redis (PTTL -2, or 0), in which case the value should not be cached at all.
+func (cache *cache) ttlFor(key string, pttl int64) (time.Duration, bool) {
+	expirationTime := cache.expirationTimeFor(key)
+	if pttl == -1 {
+		return expirationTime, true
 	}
 
-	cache.head = newNode
-	if cache.tail == nil {
-		cache.tail = newNode
+	if pttl <= 0 {
+		return 0, false
 	}
+
+	if remaining := time.Duration(pttl) * time.Millisecond; remaining < expirationTime {
+		return remaining, true
+	}
+	return expirationTime, true
 }
 
-// Removes a linked list node from the list.
-func (cache *cache) removeNodeFromList(targetNode *node) (*node) {
-	if targetNode.prev != nil {
-		targetNode.prev.next = targetNode.next
+// Returns how long values of the key are cached for: the ttl of the cache rule for the key if it sets one, and the
+// global expirationTime otherwise.
+func (cache *cache) expirationTimeFor(key string) time.Duration {
+	if rule := cache.ruleFor(key); rule != nil && rule.ttl > 0 {
+		return rule.ttl
 	}
+	return cache.expirationTime
+}
 
-	if targetNode.next != nil {
-		targetNode.next.prev = targetNode.prev
+// Reports whether the key may be cached, which is the case unless a nocache rule matches it.
+func (cache *cache) cacheable(key string) bool {
+	rule := cache.ruleFor(key)
+	return rule == nil || rule.cacheable
+}
+
+// Looks the key up in the cache. Returns statusHit and the value if it is cached, statusNotFound if the key is cached
+// as missing from Redis, statusStale and the value if it has expired but may still be served, and statusMiss
+// otherwise. Starts a background refresh of stale values, and of hot values about to expire.
+func (cache *cache) fetchFromCache(key string) (value string, status lookupStatus) {
+	shard := cache.shardFor(key)
+	value, status, refresh := shard.fetch(key)
+	if refresh {
+		cache.refreshInBackground(key, shard)
 	}
+	return value, status
+}
 
-	if targetNode == cache.head {
-		cache.head = targetNode.next
+// Places a key value pairing in the shard that owns the key, evicting the least recently used entry of its segment
+// if that is over capacity. Keys matching a nocache rule are not stored.
+func (cache *cache) putInCache(key, value string) {
+	cache.putInCacheWithTTL(key, value, cache.expirationTimeFor(key))
+}
+
+// Like putInCache, but the entry expires after ttl rather than the key's usual expiration time.
+func (cache *cache) putInCacheWithTTL(key, value string, ttl time.Duration) {
+	if n := cache.valueNodeFor(key, value, ttl); n != nil {
+		cache.shardFor(key).put(n)
+	} else {
+		// Any entry the key still has would now be out of date.
+		cache.removeKey(key)
+	}
+}
+
+// Returns a node caching the value of the key for ttl, or nil if it should not be cached: if the key is empty or its
+// rule says not to cache it, or if the value is oversized, in which case it is served but not cached.
+func (cache *cache) valueNodeFor(key, value string, ttl time.Duration) *node {
+	if key == "" || (cache.maxValueBytes > 0 && len(value) > cache.maxValueBytes) {
+		return nil
 	}
 
-	if targetNode == cache.tail {
-		cache.tail = targetNode.prev
+	segment := valuesSegment
+	if rule := cache.ruleFor(key); rule != nil {
+		if !rule.cacheable {
+			return nil
+		}
+		segment = rule.segment
 	}
 
-	return targetNode
+	n := newNode(key, value, ttl, segment)
+	n.staleUntil = n.expiresAt.Add(cache.staleWhileRevalidate)
+	n.staleIfErrorUntil = n.expiresAt.Add(cache.staleIfError)
+	if cache.refreshAhead > 0 {
+		n.refreshAt = n.expiresAt.Add(-time.Duration(float64(ttl) * cache.refreshAhead))
+	}
+	return n
 }
 
-// Logs contents of the cache in order from most to least recently used entry.
-func (cache *cache) logContents() {
-	curNode := cache.head
-	var b bytes.Buffer
-	for curNode != nil {
-		b.WriteString(fmt.Sprintf("(%s, %s) -> ", curNode.key, curNode.value))
-		curNode = curNode.next
+// Returns a node recording that the key does not exist in Redis, or nil if negative caching is disabled or the key
+// may not be cached.
+func (cache *cache) negativeNodeFor(key string) *node {
+	if key == "" || cache.negativeCapacity <= 0 || !cache.cacheable(key) {
+		return nil
 	}
-	log.Println(b.String())
+	return newNegativeNode(key, cache.negativeExpirationTime)
+}
+
+// Removes all trace of the key value pairing associated with the input key.
+func (cache *cache) removeKey(key string) {
+	cache.shardFor(key).removeKey(key)
 }
 
+// Removes the key because its value in Redis changed, keeping fetches of it already in flight from caching what they
+// fetched, since that may predate the change. Returns whether the key had an entry.
+func (cache *cache) invalidate(key string) bool {
+	return cache.shardFor(key).invalidate(key)
+}
+
+// Tells other proxies on the invalidation bus, if any, that the keys were written or deleted through this one.
+func (cache *cache) publishInvalidation(keys []string) {
+	if cache.bus != nil {
+		cache.bus.publishKeys(keys)
+	}
+}
+
+// Empties the cache, and returns the number of entries removed.
+func (cache *cache) removeAll() int {
+	removed := 0
+	for _, shard := range cache.shards {
+		removed += shard.removeAll()
+	}
+	return removed
+}
+
+// Removes the entries of all keys matching the glob pattern, and returns the number of entries removed.
+func (cache *cache) removeMatching(pattern string) int {
+	matches := globMatcher(pattern)
+	removed := 0
+	for _, shard := range cache.shards {
+		removed += shard.removeMatching(matches)
+	}
+	return removed
+}
+
+// Picks the shard for a key by hashing it, so that a key always maps to the same shard. The hash is 32-bit FNV-1a,
+// computed inline to avoid allocating on every request.
+func (cache *cache) shardFor(key string) *shard {
+	return cache.shards[cache.shardIndex(key)]
+}
+
+// Returns the index of the shard for the key in shards.
+func (cache *cache) shardIndex(key string) int {
+	if len(cache.shards) == 1 {
+		return 0
+	}
+
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+	return int(hash % uint32(len(cache.shards)))
+}
@@ -1,17 +1,22 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/gomodule/redigo/redis"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
 /**
 Test file for the cache. Names are fairly self-explanatory.
-There is a test for each requirement of the proxy, except for sequential concurrent processing.
+There is a test for each requirement of the proxy. Run with -race to check that concurrent use is safe.
  */
 
 var (
@@ -46,6 +51,12 @@ func requestValue(key string) string {
 	return string(body)
 }
 
+// Helper function that checks whether the cache holds an unexpired entry with the expected value for the key.
+func cacheHolds(cache *cache, key, expected string) bool {
+	value, status := cache.fetchFromCache(key)
+	return status == statusHit && value == expected
+}
+
 // Helper function to make requests to the Redis store booted in docker-compose.
 func setKeyValPairsInRange(start, end int) {
 	for i := start; i <= end; i++ {
@@ -77,23 +88,23 @@ func TestCacheStoresValuesFetchedFromRedis(t *testing.T) {
 	cache := NewCache(redisServer, 2, 60, maxConnections)
 	defer cache.Close()
 
-	_, fetchedFromRedis := cache.get(k1)
-	if fetchedFromRedis != true {
+	_, status, _ := cache.get(k1)
+	if status != statusMiss {
 		t.Errorf("For key %s, claimed val was not fetched from Redis but it must have been", k1)
 	}
 
-	_, fetchedFromRedis = cache.get(k2)
-	if fetchedFromRedis != true {
+	_, status, _ = cache.get(k2)
+	if status != statusMiss {
 		t.Errorf("For key %s, claimed val was not fetched from Redis but it must have been", k2)
 	}
 
-	_, fetchedFromRedis = cache.get(k2)
-	if fetchedFromRedis != false {
+	_, status, _ = cache.get(k2)
+	if status != statusHit {
 		t.Errorf("For key %s, claimed val was fetched from Redis but it should have been fetched from cache", k2)
 	}
 
-	_, fetchedFromRedis = cache.get(k1)
-	if fetchedFromRedis != false {
+	_, status, _ = cache.get(k1)
+	if status != statusHit {
 		t.Errorf("For key %s, claimed val was fetched from Redis but it should have been fetched from cache", k1)
 	}
 }
@@ -105,14 +116,18 @@ func TestCacheItemsExpireAfterSpecifiedLimit(t *testing.T) {
 
 	cache.putInCache(k1, v1)
 	time.Sleep(2 * time.Second)
-	if cache.fetchFromCache(k1) != v1 {
+	if !cacheHolds(cache, k1, v1) {
 		t.Errorf("Value expired or nil when it should have remained in cache")
 	}
 
 	time.Sleep(1 * time.Second)
-	if cache.fetchFromCache(k1) != "E" {
+	if _, status := cache.fetchFromCache(k1); status != statusMiss {
 		t.Errorf("Value expected to be expired, was not expired")
 	}
+
+	if cache.GetSize() != 0 {
+		t.Errorf("Expired value should have been removed from the cache")
+	}
 }
 
 // Checks that when the cache is at capacity, new entries evict the least recently used cache entry.
@@ -128,11 +143,11 @@ func TestLeastRecentlyUsedItemIsEvictedAtCapacity(t *testing.T) {
 	cache.fetchFromCache(k1)
 	cache.putInCache(k4, v4)
 
-	if !(cache.fetchFromCache(k3) == v3 && cache.fetchFromCache(k1) == v1 && cache.fetchFromCache(k4) == v4) {
+	if !(cacheHolds(cache, k3, v3) && cacheHolds(cache, k1, v1) && cacheHolds(cache, k4, v4)) {
 		t.Errorf("Value expired or evicted when it should have remained in cache")
 	}
 
-	if cache.fetchFromCache(k2) != "" {
+	if _, status := cache.fetchFromCache(k2); status != statusMiss {
 		t.Errorf("Value expired or present when it should have been evicted as the LRU item")
 	}
 }
@@ -151,11 +166,604 @@ func TestCacheSizeCompliesWithSpecifiedCapacity(t *testing.T) {
 		t.Errorf("Cache size exceeded specified capacity")
 	}
 
-	if !(cache.fetchFromCache(k2) == v2 && cache.fetchFromCache(k3) == v3 && cache.fetchFromCache(k4) == v4) {
+	if !(cacheHolds(cache, k2, v2) && cacheHolds(cache, k3, v3) && cacheHolds(cache, k4, v4)) {
 		t.Errorf("Value expired or evicted when it should have remained in cache")
 	}
 
-	if cache.fetchFromCache(k1) != "" {
+	if _, status := cache.fetchFromCache(k1); status != statusMiss {
 		t.Errorf("Value expired or present when it should have been evicted as the LRU item")
 	}
-}
\ No newline at end of file
+}
+
+// Walks each of a shard's segments in the order of its eviction policy and checks that together they hold exactly the
+// nodes in the shard's map.
+func checkListMatchesMap(t *testing.T, cache *cache) {
+	for _, shard := range cache.shards {
+		shard.mu.Lock()
+		count := 0
+		for _, segment := range shard.segments {
+			segmentCount := 0
+			segment.policy.each(func(curNode *node) bool {
+				if shard.key2ElementMap[curNode.key] != curNode {
+					t.Fatalf("Node for key %s is in the segment but not the map", curNode.key)
+				}
+				segmentCount++
+				return true
+			})
+
+			if segmentCount != segment.len {
+				t.Fatalf("Segment has %d nodes but its length is %d", segmentCount, segment.len)
+			}
+			count += segmentCount
+		}
+
+		if count != len(shard.key2ElementMap) {
+			t.Fatalf("Segments have %d nodes but map has %d entries", count, len(shard.key2ElementMap))
+		}
+		shard.mu.Unlock()
+	}
+}
+
+// Checks that concurrent HTTP requests, as served by net/http on separate goroutines, get correct values and leave the
+// cache consistent and within capacity.
+func TestCacheHandlesConcurrentGetValueRequests(t *testing.T) {
+	cache := NewCache(redisServer, 5, 60, maxConnections)
+	defer cache.Close()
+	setKeyValPairsInRange(1, 20)
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 16; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				n := (worker*7+i)%20 + 1
+				req := httptest.NewRequest("GET", "/", nil)
+				req.Header.Add("key", fmt.Sprintf("k%d", n))
+				recorder := httptest.NewRecorder()
+				cache.GetValue(recorder, req)
+				if expected := fmt.Sprintf("v%d", n); recorder.Body.String() != expected {
+					t.Errorf("For key k%d, expected %s but got %s", n, expected, recorder.Body.String())
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	if cache.GetSize() > 5 {
+		t.Errorf("Cache size %d exceeded specified capacity", cache.GetSize())
+	}
+	checkListMatchesMap(t, cache)
+}
+
+// Checks that concurrent inserts, lookups and removals of overlapping keys leave the cache consistent.
+func TestCacheStaysConsistentUnderConcurrentMutation(t *testing.T) {
+	cache := NewCache(redisServer, 8, 60, maxConnections)
+	defer cache.Close()
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				key := fmt.Sprintf("k%d", (worker+i)%12)
+				switch i % 3 {
+				case 0:
+					cache.putInCache(key, "v")
+				case 1:
+					cache.fetchFromCache(key)
+				case 2:
+					cache.removeKey(key)
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	if cache.GetSize() > 8 {
+		t.Errorf("Cache size %d exceeded specified capacity", cache.GetSize())
+	}
+	checkListMatchesMap(t, cache)
+}
+
+// Checks that once maxConnections connections are in use, a miss waits for one to be returned to the pool instead of
+// opening another connection or failing.
+func TestCacheWaitsForPooledConnectionAtMaxActive(t *testing.T) {
+	cache := NewCache(redisServer, 2, 60, maxConnections)
+	defer cache.Close()
+
+	var borrowed []redis.Conn
+	for i := 0; i < maxConnections; i++ {
+		conn := cache.pool.Get()
+		conn.Do("PING")
+		borrowed = append(borrowed, conn)
+	}
+
+	done := make(chan string)
+	go func() {
+		value, _, _ := cache.get(k1)
+		done <- value
+	}()
+
+	select {
+	case <-done:
+		t.Fatalf("Fetched from Redis while all %d pooled connections were in use", maxConnections)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	borrowed[0].Close()
+	select {
+	case value := <-done:
+		if value != v1 {
+			t.Errorf("For key %s, expected %s but got %s", k1, v1, value)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("Still waiting for a connection after one was returned to the pool")
+	}
+
+	for _, conn := range borrowed[1:] {
+		conn.Close()
+	}
+
+	if active := cache.pool.ActiveCount(); active > maxConnections {
+		t.Errorf("Pool has %d active connections, more than the maximum of %d", active, maxConnections)
+	}
+}
+
+// Checks that capacity is split between shards, that keys spread across them, and that the total never exceeds
+// capacity.
+func TestShardedCacheSplitsCapacityBetweenShards(t *testing.T) {
+	cache := NewCache(redisServer, 10, 60, maxConnections, WithShards(4))
+	defer cache.Close()
+
+	capacities := []int{}
+	for _, shard := range cache.shards {
+		capacities = append(capacities, shard.segments[valuesSegment].capacity)
+	}
+	if fmt.Sprint(capacities) != "[3 3 2 2]" {
+		t.Errorf("Expected shard capacities [3 3 2 2] but got %v", capacities)
+	}
+
+	for i := 0; i < 100; i++ {
+		cache.putInCache(fmt.Sprintf("k%d", i), "v")
+	}
+
+	for i, shard := range cache.shards {
+		if capacity := shard.segments[valuesSegment].capacity; shard.size() != capacity {
+			t.Errorf("Expected shard %d to be full with %d entries, but it has %d", i, capacity, shard.size())
+		}
+	}
+
+	if cache.GetSize() != 10 {
+		t.Errorf("Expected 10 entries across all shards, got %d", cache.GetSize())
+	}
+	checkListMatchesMap(t, cache)
+
+	if small := NewCache(redisServer, 2, 60, maxConnections, WithShards(16)); len(small.shards) != 2 {
+		t.Errorf("Expected shard count to be capped at the capacity of 2, got %d", len(small.shards))
+	} else {
+		small.Close()
+	}
+}
+
+// Checks that a key is always served by the same shard, so lookups find what was stored.
+func TestShardedCacheFindsStoredValues(t *testing.T) {
+	cache := NewCache(redisServer, 64, 60, maxConnections, WithShards(8))
+	defer cache.Close()
+
+	for i := 0; i < 32; i++ {
+		cache.putInCache(fmt.Sprintf("k%d", i), fmt.Sprintf("v%d", i))
+	}
+
+	for i := 0; i < 32; i++ {
+		if !cacheHolds(cache, fmt.Sprintf("k%d", i), fmt.Sprintf("v%d", i)) {
+			t.Errorf("For key k%d, expected v%d to be cached", i, i)
+		}
+	}
+}
+
+// Compares throughput of the single-lock cache (shards=1) with sharded ones, under a parallel mix of hits and inserts.
+// Run with: go test -run NONE -bench CacheParallel -cpu 1,8,32
+func BenchmarkCacheParallel(b *testing.B) {
+	keys := make([]string, 4096)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key:%d", i)
+	}
+
+	for _, shards := range []int{1, 4, 16, 64} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			cache := NewCache(redisServer, 2048, 60, maxConnections, WithShards(shards))
+			defer cache.Close()
+			for _, key := range keys {
+				cache.putInCache(key, "value")
+			}
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := rand.Intn(len(keys))
+				for pb.Next() {
+					key := keys[(i*31)%len(keys)]
+					if i%10 == 0 {
+						cache.putInCache(key, "value")
+					} else {
+						cache.fetchFromCache(key)
+					}
+					i++
+				}
+			})
+		})
+	}
+}
+
+// Checks that concurrent misses on the same key share one Redis fetch, and are counted as coalesced.
+func TestCacheCoalescesConcurrentMisses(t *testing.T) {
+	cache := NewCache(redisServer, 2, 60, maxConnections)
+	defer cache.Close()
+	redisDirect.Do("SET", "hot", "value")
+
+	// Hold every pooled connection so that the first miss blocks in its fetch while the others pile up behind it.
+	var borrowed []redis.Conn
+	for i := 0; i < maxConnections; i++ {
+		conn := cache.pool.Get()
+		conn.Do("PING")
+		borrowed = append(borrowed, conn)
+	}
+
+	const callers = 10
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if value, _, _ := cache.get("hot"); value != "value" {
+				t.Errorf("Expected value but got %s", value)
+			}
+		}()
+	}
+
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		cache.flights.mu.Lock()
+		f := cache.flights.flights["hot"]
+		joined := f != nil && f.dups == callers-1
+		cache.flights.mu.Unlock()
+		if joined {
+			break
+		}
+	}
+
+	for _, conn := range borrowed {
+		conn.Close()
+	}
+	wg.Wait()
+
+	if coalesced := cache.GetStats().Coalesced; coalesced != callers-1 {
+		t.Errorf("Expected %d coalesced requests, got %d", callers-1, coalesced)
+	}
+}
+
+// Helper function that serves a GET for the key through GetValue, without going through the HTTP service.
+func recordGetValue(cache *cache, key string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/", nil)
+	if key != "" {
+		req.Header.Add("key", key)
+	}
+	recorder := httptest.NewRecorder()
+	cache.GetValue(recorder, req)
+	return recorder
+}
+
+// Checks that missing keys, empty values, values that used to be sentinels, and backend failures are all told apart.
+func TestGetValueDistinguishesMissingKeysEmptyValuesAndErrors(t *testing.T) {
+	cache := NewCache(redisServer, 10, 60, maxConnections)
+	redisDirect.Do("SET", "empty", "")
+	redisDirect.Do("SET", "e", "E")
+	redisDirect.Do("DEL", "missing", "list")
+	redisDirect.Do("RPUSH", "list", "x")
+
+	for _, expectedCache := range []string{"MISS", "HIT"} {
+		res := recordGetValue(cache, "empty")
+		if res.Code != http.StatusOK || res.Body.String() != "" || res.Header().Get("X-Cache") != expectedCache {
+			t.Errorf("For an empty value, expected 200 %s with empty body but got %d %s %q", expectedCache, res.Code,
+				res.Header().Get("X-Cache"), res.Body.String())
+		}
+
+		res = recordGetValue(cache, "e")
+		if res.Code != http.StatusOK || res.Body.String() != "E" || res.Header().Get("X-Cache") != expectedCache {
+			t.Errorf("For value E, expected 200 %s with body E but got %d %s %q", expectedCache, res.Code,
+				res.Header().Get("X-Cache"), res.Body.String())
+		}
+	}
+
+	if res := recordGetValue(cache, "missing"); res.Code != http.StatusNotFound {
+		t.Errorf("For a missing key, expected 404 but got %d", res.Code)
+	}
+
+	if res := recordGetValue(cache, "list"); res.Code != http.StatusBadGateway {
+		t.Errorf("For a key holding a list, expected 502 but got %d", res.Code)
+	}
+
+	if res := recordGetValue(cache, ""); res.Code != http.StatusBadRequest {
+		t.Errorf("For a request without a key, expected 400 but got %d", res.Code)
+	}
+
+	cache.Close()
+	if res := recordGetValue(cache, "missing"); res.Code != http.StatusServiceUnavailable {
+		t.Errorf("With Redis unreachable, expected 503 but got %d", res.Code)
+	}
+}
+
+// Checks that keys missing from Redis are cached as missing when negative caching is enabled, expire after their own
+// TTL, and are only evicted by other negative entries.
+func TestCacheCachesMissingKeysWithTheirOwnTTLAndCapacity(t *testing.T) {
+	cache := NewCache(redisServer, 2, 60, maxConnections, WithNegativeCaching(time.Second, 2))
+	defer cache.Close()
+	redisDirect.Do("DEL", "missing1", "missing2", "missing3")
+
+	cache.putInCache(k1, v1)
+	cache.putInCache(k2, v2)
+	for _, key := range []string{"missing1", "missing2", "missing3"} {
+		if _, status, _ := cache.get(key); status != statusNotFound {
+			t.Errorf("For key %s, expected not found but got %v", key, status)
+		}
+	}
+
+	if !(cacheHolds(cache, k1, v1) && cacheHolds(cache, k2, v2)) {
+		t.Errorf("Negative entries should not evict values")
+	}
+
+	if _, status := cache.fetchFromCache("missing1"); status != statusMiss {
+		t.Errorf("Expected the least recently used negative entry to be evicted, got %v", status)
+	}
+
+	if _, status := cache.fetchFromCache("missing3"); status != statusNotFound {
+		t.Errorf("Expected a cached negative entry, got %v", status)
+	}
+
+	// Once cached as missing, the key is not looked up in Redis again until the negative entry expires.
+	redisDirect.Do("SET", "missing3", "v")
+	if _, status, _ := cache.get("missing3"); status != statusNotFound {
+		t.Errorf("Expected the negative entry to be served, got %v", status)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	if value, status, _ := cache.get("missing3"); status != statusMiss || value != "v" {
+		t.Errorf("Expected the negative entry to expire and the value to be fetched, got %v %q", status, value)
+	}
+	checkListMatchesMap(t, cache)
+}
+
+// Checks that with fewer negative entries allowed than there are shards, every shard can still cache missing keys.
+func TestCacheCachesMissingKeysInEveryShard(t *testing.T) {
+	cache := NewCache(redisServer, 8, 60, maxConnections, WithNegativeCaching(time.Minute, 2), WithShards(4))
+	defer cache.Close()
+
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("missing:%d", i)
+		redisDirect.Do("DEL", key)
+		cache.get(key)
+		if _, status := cache.fetchFromCache(key); status != statusNotFound {
+			t.Errorf("Expected %s to be cached as missing, whichever shard holds it, got %v", key, status)
+		}
+	}
+}
+
+// Checks that missing keys are not cached unless negative caching is enabled.
+func TestCacheDoesNotCacheMissingKeysByDefault(t *testing.T) {
+	cache := NewCache(redisServer, 2, 60, maxConnections)
+	defer cache.Close()
+	redisDirect.Do("DEL", "missing1")
+
+	cache.get("missing1")
+	if _, status := cache.fetchFromCache("missing1"); status != statusMiss {
+		t.Errorf("Expected no negative entry, got %v", status)
+	}
+}
+
+// Checks that values are cached no longer than their remaining TTL in Redis, and for the global expiry time otherwise.
+func TestCacheHonorsRedisKeyTTLs(t *testing.T) {
+	cache := NewCache(redisServer, 5, 60, maxConnections)
+	defer cache.Close()
+	redisDirect.Do("SET", "short", "v", "PX", 1500)
+	redisDirect.Do("SET", "long", "v", "EX", 3600)
+	redisDirect.Do("SET", "forever", "v")
+
+	expected := map[string]time.Duration{"short": 1500 * time.Millisecond, "long": time.Minute, "forever": time.Minute}
+	for key, ttl := range expected {
+		cache.get(key)
+
+		shard := cache.shardFor(key)
+		shard.mu.Lock()
+		foundNode, ok := shard.key2ElementMap[key]
+		shard.mu.Unlock()
+		if !ok {
+			t.Fatalf("For key %s, expected the value to be cached", key)
+		}
+
+		if remaining := foundNode.expiresAt.Sub(foundNode.creationTime); remaining > ttl || remaining < ttl-time.Second {
+			t.Errorf("For key %s, expected to be cached for %v, but expires in %v", key, ttl, remaining)
+		}
+	}
+
+	time.Sleep(1600 * time.Millisecond)
+	if _, status := cache.fetchFromCache("short"); status != statusMiss {
+		t.Errorf("Expected the value to expire along with the key in Redis, got %v", status)
+	}
+
+	if !cacheHolds(cache, "long", "v") {
+		t.Errorf("Expected the value with a long TTL in Redis to remain cached")
+	}
+}
+
+// Checks how a key's PTTL in Redis limits the time a value is cached.
+func TestTTLForCapsGlobalExpiryAtRedisTTL(t *testing.T) {
+	cache := NewCache(redisServer, 1, 60, maxConnections)
+	defer cache.Close()
+
+	cases := []struct {
+		pttl      int64
+		ttl       time.Duration
+		cacheable bool
+	}{
+		{-1, time.Minute, true},
+		{-2, 0, false},
+		{0, 0, false},
+		{250, 250 * time.Millisecond, true},
+		{3600000, time.Minute, true},
+	}
+
+	for _, c := range cases {
+		ttl, cacheable := cache.ttlFor("k", c.pttl)
+		if ttl != c.ttl || cacheable != c.cacheable {
+			t.Errorf("For PTTL %d, expected (%v, %v) but got (%v, %v)", c.pttl, c.ttl, c.cacheable, ttl, cacheable)
+		}
+	}
+}
+
+// Checks that with a byte limit and no entry limit, entries are evicted until the cache is back under budget, and
+// that an entry too large for the whole budget is not cached.
+func TestCacheEvictsToStayUnderMaxBytes(t *testing.T) {
+	entryBytes := nodeOverhead + len("b1") + 10
+	cache := NewCache(redisServer, 0, 60, maxConnections, WithMaxBytes(3*entryBytes))
+	defer cache.Close()
+
+	for _, key := range []string{"b1", "b2", "b3", "b4"} {
+		cache.putInCache(key, "0123456789")
+	}
+
+	if cache.GetSize() != 3 || cache.GetBytes() != 3*entryBytes {
+		t.Errorf("Expected 3 entries in %d bytes, got %d in %d", 3*entryBytes, cache.GetSize(), cache.GetBytes())
+	}
+	if cacheHolds(cache, "b1", "0123456789") {
+		t.Errorf("Expected the least recently used entry to be evicted")
+	}
+
+	// Takes the room of two entries, so two more are evicted.
+	cache.putInCache("b5", string(make([]byte, entryBytes+10)))
+	if cache.GetSize() != 2 || cache.GetBytes() > 3*entryBytes {
+		t.Errorf("Expected 2 entries within %d bytes, got %d in %d", 3*entryBytes, cache.GetSize(), cache.GetBytes())
+	}
+
+	cache.putInCache("b6", string(make([]byte, 3*entryBytes)))
+	if _, status := cache.fetchFromCache("b6"); status != statusMiss || cache.GetSize() != 2 {
+		t.Errorf("Expected an entry larger than the budget not to be cached, nor to evict anything")
+	}
+	checkListMatchesMap(t, cache)
+}
+
+// Checks that the entry limit still applies when a byte limit is set too.
+func TestCacheAppliesEntryAndByteLimitsTogether(t *testing.T) {
+	cache := NewCache(redisServer, 2, 60, maxConnections, WithMaxBytes(1<<20))
+	defer cache.Close()
+
+	cache.putInCache(k1, v1)
+	cache.putInCache(k2, v2)
+	cache.putInCache(k3, v3)
+	if cache.GetSize() != 2 {
+		t.Errorf("Expected capacity of 2 entries to apply, got %d entries", cache.GetSize())
+	}
+}
+
+// Checks that values over the size ceiling are served from Redis but not cached, while smaller ones still are.
+func TestCachePassesThroughValuesOverMaxValueBytes(t *testing.T) {
+	cache := NewCache(redisServer, 2, 60, maxConnections, WithMaxValueBytes(50))
+	defer cache.Close()
+	huge := string(make([]byte, 100))
+	redisDirect.Do("SET", "huge", huge)
+	redisDirect.Do("SET", "small", "v")
+
+	for i := 0; i < 2; i++ {
+		if value, status, _ := cache.get("huge"); status != statusMiss || value != huge {
+			t.Errorf("Expected the huge value to be fetched from Redis every time, got %v", status)
+		}
+	}
+
+	cache.get("small")
+	if !cacheHolds(cache, "small", "v") {
+		t.Errorf("Expected the small value to be cached")
+	}
+}
+
+// Helper function that posts a batch lookup to the cache's handler directly, and returns the recorded response.
+func recordGetValues(cache *cache, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/batch", strings.NewReader(body))
+	res := httptest.NewRecorder()
+	cache.GetValues(res, req)
+	return res
+}
+
+// Checks that a batch lookup serves cached keys from the cache, fetches the others from Redis and caches them, and
+// maps missing keys to null.
+func TestGetValuesServesHitsAndFetchesMisses(t *testing.T) {
+	cache := NewCache(redisServer, 10, 60, maxConnections)
+	defer cache.Close()
+	redisDirect.Do("SET", "batch:cached", "from redis")
+	redisDirect.Do("SET", "batch:fetched", "fetched")
+	redisDirect.Do("SET", "batch:empty", "")
+	redisDirect.Do("DEL", "batch:missing")
+	cache.putInCache("batch:cached", "from cache")
+
+	res := recordGetValues(cache, `["batch:cached", "batch:fetched", "batch:empty", "batch:missing", "batch:fetched"]`)
+	if res.Code != http.StatusOK || res.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("Expected a JSON response, got %d %s", res.Code, res.Body.String())
+	}
+
+	var values map[string]*string
+	if err := json.Unmarshal(res.Body.Bytes(), &values); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(values) != 4 || values["batch:missing"] != nil {
+		t.Errorf("Expected 4 keys with batch:missing null, got %s", res.Body.String())
+	}
+	expected := map[string]string{"batch:cached": "from cache", "batch:fetched": "fetched", "batch:empty": ""}
+	for key, value := range expected {
+		if values[key] == nil || *values[key] != value {
+			t.Errorf("For key %s, expected %q, got %s", key, value, res.Body.String())
+		}
+	}
+
+	if !cacheHolds(cache, "batch:fetched", "fetched") || !cacheHolds(cache, "batch:empty", "") {
+		t.Errorf("Expected values fetched by the batch to be cached")
+	}
+}
+
+// Checks that keys holding other types are reported as null but not cached as missing.
+func TestGetManyDoesNotCacheOtherTypesAsMissing(t *testing.T) {
+	cache := NewCache(redisServer, 10, 60, maxConnections, WithNegativeCaching(time.Minute, 10))
+	defer cache.Close()
+	redisDirect.Do("DEL", "batch:list", "batch:missing")
+	redisDirect.Do("RPUSH", "batch:list", "x")
+
+	values, err := cache.getMany([]string{"batch:list", "batch:missing"})
+	if err != nil || values["batch:list"] != nil || values["batch:missing"] != nil {
+		t.Fatalf("Expected both keys to be null, got %v (%v)", values, err)
+	}
+
+	if _, status := cache.fetchFromCache("batch:missing"); status != statusNotFound {
+		t.Errorf("Expected the missing key to be cached as missing, got %v", status)
+	}
+	if _, status := cache.fetchFromCache("batch:list"); status != statusMiss {
+		t.Errorf("Expected the list not to be cached, got %v", status)
+	}
+}
+
+// Checks that malformed and oversized batches are rejected, and that a failing Redis is reported.
+func TestGetValuesRejectsBadRequests(t *testing.T) {
+	cache := NewCache(redisServer, 10, 60, maxConnections)
+	defer cache.Close()
+
+	if res := recordGetValues(cache, `{"key": "k1"}`); res.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a body that is not an array of keys, got %d", res.Code)
+	}
+
+	keys, _ := json.Marshal(make([]string, maxBatchKeys+1))
+	if res := recordGetValues(cache, string(keys)); res.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for too many keys, got %d", res.Code)
+	}
+
+	cache.pool.Close()
+	if res := recordGetValues(cache, `["batch:unreachable"]`); res.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 with Redis unreachable, got %d", res.Code)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"strings"
+)
+
+/**
+Eviction policies decide which entry a full segment of a shard gives up to make room for a new one. Each segment has
+its own policy instance, guarded by the shard's lock, so implementations need not be safe for concurrent use.
+
+  lru      evicts the least recently used entry
+  lfu      evicts the least frequently used entry, the least recently used among ties
+  arc      Adaptive Replacement Cache: balances recency and frequency, adapting to the workload
+  tinylfu  W-TinyLFU: a small LRU window in front of a segmented LRU, admitting entries by estimated frequency
+  s3fifo   S3-FIFO: a small probationary FIFO queue in front of a main FIFO queue, with a ghost queue of evicted keys
+
+ARC, W-TinyLFU and S3-FIFO are scan resistant: a batch job reading many keys once does not flush frequently used
+entries from the cache, as it does with LRU.
+ */
+
+type evictionPolicy interface {
+	// Called when a node is added to the segment.
+	add(n *node)
+	// Called when a node in the segment is read.
+	touch(n *node)
+	// Called when a node leaves the segment other than by eviction: it expired, was replaced or was removed.
+	remove(n *node)
+	// Removes the node that should be evicted next from the policy, and returns it. Only called when the segment is
+	// not empty. May return the node that was just added, if the policy declines to admit it.
+	evict() *node
+	// Calls fn for each node, roughly from the most to the least worth keeping, until fn returns false.
+	each(fn func(n *node) bool)
+}
+
+// Creates a policy for a segment that holds up to capacity entries.
+type policyFactory func(capacity int) evictionPolicy
+
+var evictionPolicies = map[string]policyFactory{
+	"lru":     newLRUPolicy,
+	"lfu":     newLFUPolicy,
+	"arc":     newARCPolicy,
+	"tinylfu": newTinyLFUPolicy,
+	"s3fifo":  newS3FIFOPolicy,
+}
+
+// Returns the factory for the named eviction policy.
+func evictionPolicyByName(name string) (policyFactory, error) {
+	newPolicy, ok := evictionPolicies[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unknown eviction policy %q, expected one of lru, lfu, arc, tinylfu or s3fifo", name)
+	}
+	return newPolicy, nil
+}
+
+// A doubly linked list of nodes, threaded through the nodes' prev and next pointers, so a node can be in at most one
+// list at a time. Policies use them as LRU lists or FIFO queues, with the newest node at the head.
+type nodeList struct {
+	head, tail *node
+	len        int
+}
+
+// Inserts a linked list node at the start of the list.
+func (list *nodeList) insertNodeAtListFront(newNode *node) {
+	newNode.prev = nil
+	newNode.next = list.head
+	if newNode.next != nil {
+		newNode.next.prev = newNode
+	}
+
+	list.head = newNode
+	if list.tail == nil {
+		list.tail = newNode
+	}
+	list.len++
+}
+
+// Removes a linked list node from the list.
+func (list *nodeList) removeNodeFromList(targetNode *node) *node {
+	if targetNode.prev != nil {
+		targetNode.prev.next = targetNode.next
+	}
+
+	if targetNode.next != nil {
+		targetNode.next.prev = targetNode.prev
+	}
+
+	if targetNode == list.head {
+		list.head = targetNode.next
+	}
+
+	if targetNode == list.tail {
+		list.tail = targetNode.prev
+	}
+
+	targetNode.prev, targetNode.next = nil, nil
+	list.len--
+	return targetNode
+}
+
+// Moves a node that is already in the list to its start.
+func (list *nodeList) moveToFront(n *node) {
+	if list.head != n {
+		list.removeNodeFromList(n)
+		list.insertNodeAtListFront(n)
+	}
+}
+
+// Calls fn for each node from head to tail, until fn returns false. Returns false if fn did.
+func (list *nodeList) each(fn func(n *node) bool) bool {
+	for curNode := list.head; curNode != nil; curNode = curNode.next {
+		if !fn(curNode) {
+			return false
+		}
+	}
+	return true
+}
+
+// Keys of recently evicted entries, oldest first out, which lets a policy recognize a key that comes back soon after
+// being evicted. Only keys are kept, not values.
+type ghostList struct {
+	order    *list.List
+	elements map[string]*list.Element
+}
+
+func newGhostList() *ghostList {
+	return &ghostList{order: list.New(), elements: make(map[string]*list.Element)}
+}
+
+func (ghosts *ghostList) len() int {
+	return ghosts.order.Len()
+}
+
+func (ghosts *ghostList) contains(key string) bool {
+	_, ok := ghosts.elements[key]
+	return ok
+}
+
+// Adds a key as the newest ghost.
+func (ghosts *ghostList) push(key string) {
+	ghosts.remove(key)
+	ghosts.elements[key] = ghosts.order.PushFront(key)
+}
+
+func (ghosts *ghostList) remove(key string) {
+	if element, ok := ghosts.elements[key]; ok {
+		ghosts.order.Remove(element)
+		delete(ghosts.elements, key)
+	}
+}
+
+// Forgets the oldest ghosts until at most n remain.
+func (ghosts *ghostList) trimTo(n int) {
+	for ghosts.order.Len() > n {
+		ghosts.remove(ghosts.order.Back().Value.(string))
+	}
+}
+
+// Least recently used: every read moves an entry to the front of the list, and entries are evicted from its end.
+type lruPolicy struct {
+	list nodeList
+}
+
+func newLRUPolicy(capacity int) evictionPolicy {
+	return new(lruPolicy)
+}
+
+func (policy *lruPolicy) add(n *node) {
+	policy.list.insertNodeAtListFront(n)
+}
+
+func (policy *lruPolicy) touch(n *node) {
+	policy.list.moveToFront(n)
+}
+
+func (policy *lruPolicy) remove(n *node) {
+	policy.list.removeNodeFromList(n)
+}
+
+func (policy *lruPolicy) evict() *node {
+	return policy.list.removeNodeFromList(policy.list.tail)
+}
+
+func (policy *lruPolicy) each(fn func(n *node) bool) {
+	policy.list.each(fn)
+}
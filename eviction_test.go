@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+)
+
+// Creates a single shard cache, without a Redis connection, whose values segment holds capacity entries.
+func newPolicyTestCache(capacity int, newPolicy policyFactory) *cache {
+	return &cache{shards: []*shard{newShard([]segmentLimits{valuesSegment: {entries: capacity}, negativeSegment: {}}, newPolicy)}}
+}
+
+// Reads the key from the shard, and caches it on a miss. Returns whether it was a hit.
+func readThrough(shard *shard, key string) bool {
+	if _, status, _ := shard.fetch(key); status == statusHit {
+		return true
+	}
+	shard.put(newNode(key, key, time.Hour, valuesSegment))
+	return false
+}
+
+func policyNames() []string {
+	var names []string
+	for name := range evictionPolicies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Checks that policies are looked up by name regardless of case, and that unknown names are rejected.
+func TestEvictionPolicyByName(t *testing.T) {
+	for _, name := range []string{"lru", "LFU", "arc", "TinyLFU", "s3fifo"} {
+		if _, err := evictionPolicyByName(name); err != nil {
+			t.Errorf("Policy %s not found: %v", name, err)
+		}
+	}
+
+	if _, err := evictionPolicyByName("random"); err == nil {
+		t.Errorf("Unknown policy accepted")
+	}
+}
+
+// Checks that under a random mix of reads, writes, replacements and removals, every policy keeps track of exactly the
+// nodes in the shard, and the shard never holds more entries than its capacity.
+func TestEvictionPoliciesStayConsistent(t *testing.T) {
+	for _, name := range policyNames() {
+		cache := newPolicyTestCache(50, evictionPolicies[name])
+		shard := cache.shards[0]
+		random := rand.New(rand.NewSource(1))
+
+		for i := 0; i < 20000; i++ {
+			key := fmt.Sprintf("key%d", random.Intn(200))
+			switch random.Intn(10) {
+			case 0:
+				shard.removeKey(key)
+			case 1:
+				shard.put(newNode(key, "replaced", time.Hour, valuesSegment))
+			default:
+				readThrough(shard, key)
+			}
+
+			if size := shard.size(); size > 50 {
+				t.Fatalf("Policy %s: shard holds %d entries with capacity 50", name, size)
+			}
+		}
+		checkListMatchesMap(t, cache)
+	}
+}
+
+// Checks that LFU evicts the least frequently read entry rather than the least recently read one.
+func TestLFUEvictsLeastFrequentlyUsed(t *testing.T) {
+	shard := newPolicyTestCache(2, newLFUPolicy).shards[0]
+	readThrough(shard, k1)
+	readThrough(shard, k1)
+	readThrough(shard, k2)
+	readThrough(shard, k3)
+
+	if !cacheHoldsKey(shard, k1) || cacheHoldsKey(shard, k2) || !cacheHoldsKey(shard, k3) {
+		t.Errorf("LFU did not evict the least frequently read key")
+	}
+}
+
+func cacheHoldsKey(shard *shard, key string) bool {
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	_, ok := shard.key2ElementMap[key]
+	return ok
+}
+
+// Checks that the scan resistant policies keep frequently read keys cached through a scan of keys read once, unlike
+// LRU.
+func TestScanResistantPoliciesKeepHotKeys(t *testing.T) {
+	for _, name := range policyNames() {
+		shard := newPolicyTestCache(100, evictionPolicies[name]).shards[0]
+		for round := 0; round < 10; round++ {
+			for i := 0; i < 20; i++ {
+				readThrough(shard, fmt.Sprintf("hot%d", i))
+			}
+		}
+
+		for i := 0; i < 1000; i++ {
+			readThrough(shard, fmt.Sprintf("scan%d", i))
+		}
+
+		kept := 0
+		for i := 0; i < 20; i++ {
+			if cacheHoldsKey(shard, fmt.Sprintf("hot%d", i)) {
+				kept++
+			}
+		}
+
+		switch name {
+		case "lru":
+			if kept != 0 {
+				t.Errorf("LRU kept %d hot keys through the scan", kept)
+			}
+		case "arc", "tinylfu", "s3fifo":
+			if kept != 20 {
+				t.Errorf("Policy %s kept only %d of 20 hot keys through the scan", name, kept)
+			}
+		}
+	}
+}
+
+// Generates a trace of reads over a Zipf distributed set of keys, interrupted by periodic scans of keys that are read
+// only once, like a batch job running alongside regular traffic.
+func scanHeavyTrace() []string {
+	random := rand.New(rand.NewSource(42))
+	zipf := rand.NewZipf(random, 1.1, 1, 9999)
+
+	var trace []string
+	scanned := 0
+	for i := 0; i < 200000; i++ {
+		trace = append(trace, fmt.Sprintf("key%d", zipf.Uint64()))
+		if i%10000 == 9999 {
+			for j := 0; j < 2000; j++ {
+				trace = append(trace, fmt.Sprintf("scan%d", scanned))
+				scanned++
+			}
+		}
+	}
+	return trace
+}
+
+// Replays the trace against each policy and compares hit ratios. The scan resistant policies should beat LRU.
+func TestEvictionPolicyHitRatios(t *testing.T) {
+	trace := scanHeavyTrace()
+	ratios := make(map[string]float64)
+	for _, name := range policyNames() {
+		shard := newPolicyTestCache(500, evictionPolicies[name]).shards[0]
+		hits := 0
+		for _, key := range trace {
+			if readThrough(shard, key) {
+				hits++
+			}
+		}
+
+		ratios[name] = float64(hits) / float64(len(trace))
+		t.Logf("%-8s hit ratio %.4f", name, ratios[name])
+	}
+
+	for _, name := range []string{"arc", "tinylfu", "s3fifo"} {
+		if ratios[name] <= ratios["lru"] {
+			t.Errorf("Policy %s hit ratio %.4f is not above LRU's %.4f", name, ratios[name], ratios["lru"])
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import "strings"
+
+/**
+Glob-style pattern matching, with the same syntax as the Redis KEYS command:
+  *      matches any sequence of characters, including none
+  ?      matches any single character
+  [abc]  matches one of the listed characters; [^abc] any character not listed, and [a-z] a range
+  \x     matches the character x literally
+ */
+
+// Reports whether the key matches the glob pattern.
+func globMatch(pattern, key string) bool {
+	p, k := 0, 0
+	// Position to resume from if the current attempt fails after the most recent '*': the pattern index just past
+	// the star, and the key index the star will be extended to cover.
+	starP, starK := -1, 0
+
+	for k < len(key) {
+		if p < len(pattern) {
+			switch pattern[p] {
+			case '*':
+				starP, starK = p+1, k
+				p++
+				continue
+			case '?':
+				p++
+				k++
+				continue
+			case '[':
+				if matched, next, ok := matchClass(pattern, p, key[k]); ok && matched {
+					p = next
+					k++
+					continue
+				} else if !ok && key[k] == '[' {
+					// An unterminated class is taken as a literal '['.
+					p++
+					k++
+					continue
+				}
+			case '\\':
+				if p+1 < len(pattern) && pattern[p+1] == key[k] {
+					p += 2
+					k++
+					continue
+				}
+			default:
+				if pattern[p] == key[k] {
+					p++
+					k++
+					continue
+				}
+			}
+		}
+
+		if starP < 0 {
+			return false
+		}
+		starK++
+		p, k = starP, starK
+	}
+
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// Matches c against the character class starting at pattern[start], which is '['. Returns whether c matched, the
+// index just past the closing ']', and false for ok if the class is not terminated.
+func matchClass(pattern string, start int, c byte) (matched bool, next int, ok bool) {
+	i := start + 1
+	negate := false
+	if i < len(pattern) && pattern[i] == '^' {
+		negate = true
+		i++
+	}
+
+	for ; i < len(pattern) && pattern[i] != ']'; i++ {
+		switch {
+		case pattern[i] == '\\' && i+1 < len(pattern):
+			i++
+			if pattern[i] == c {
+				matched = true
+			}
+		case i+2 < len(pattern) && pattern[i+1] == '-' && pattern[i+2] != ']':
+			low, high := pattern[i], pattern[i+2]
+			if low > high {
+				low, high = high, low
+			}
+			if c >= low && c <= high {
+				matched = true
+			}
+			i += 2
+		default:
+			if pattern[i] == c {
+				matched = true
+			}
+		}
+	}
+
+	if i >= len(pattern) {
+		return false, 0, false
+	}
+	return matched != negate, i + 1, true
+}
+
+// Returns the literal prefix if the pattern is a plain prefix followed by a single trailing '*', such as "session:*",
+// so it can be matched with strings.HasPrefix instead.
+func globPrefix(pattern string) (prefix string, ok bool) {
+	if len(pattern) == 0 || pattern[len(pattern)-1] != '*' {
+		return "", false
+	}
+
+	prefix = pattern[:len(pattern)-1]
+	for i := 0; i < len(prefix); i++ {
+		switch prefix[i] {
+		case '*', '?', '[', '\\':
+			return "", false
+		}
+	}
+	return prefix, true
+}
+
+// Returns a pattern matching the string literally, with the characters special to patterns escaped.
+func globEscape(s string) string {
+	var escaped []byte
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '*', '?', '[', ']', '\\':
+			escaped = append(escaped, '\\')
+		}
+		escaped = append(escaped, s[i])
+	}
+	return string(escaped)
+}
+
+// Returns a function reporting whether a key matches the glob pattern, matching plain prefixes without globbing.
+func globMatcher(pattern string) func(key string) bool {
+	if prefix, ok := globPrefix(pattern); ok {
+		return func(key string) bool { return strings.HasPrefix(key, prefix) }
+	}
+	return func(key string) bool { return globMatch(pattern, key) }
+}
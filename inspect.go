@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+/**
+Read-only admin endpoints show what the cache holds, so that it can be inspected live. Like the purge endpoints (see
+admin.go), they are only served if an admin token is configured, and require it.
+  GET /admin/keys?offset=<n>&limit=<n>  lists entries shard by shard and segment by segment, each from the entry its
+                                        eviction policy most wants to keep to the next one it would evict, which for
+                                        lru is from the most to the least recently used
+  GET /admin/keys/<key>                 describes the key's entry, addressed as for reads, or 404 if it is not cached
+  GET /admin/stats                      summarizes the cache: the counters of GetStats, and entries and bytes by segment
+Entries are described by their metadata, never their values: their age, remaining TTL (negative once expired and only
+kept to be served stale), time since last read, size, hits, and source, which is "redis" for values fetched from Redis
+and "write" for values written through the proxy. With encoding=base64 or base64url, keys are listed in that encoding.
+Looking entries up here doesn't count as reading them, so inspecting the cache doesn't change what it evicts. Shards
+are listed one at a time without stopping the cache, so entries that move between pages may be listed twice or not at
+all.
+ */
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// What the admin endpoints tell of an entry. Durations are in seconds.
+type entryInfo struct {
+	Key      string  `json:"key"`
+	Shard    int     `json:"shard"`
+	Segment  string  `json:"segment"`
+	Negative bool    `json:"negative,omitempty"`
+	Source   string  `json:"source"`
+	Age      float64 `json:"age"`
+	TTL      float64 `json:"ttl"`
+	Idle     float64 `json:"idle"`
+	Bytes    int     `json:"bytes"`
+	Hits     int     `json:"hits"`
+}
+
+type entryList struct {
+	Total   int         `json:"total"`
+	Offset  int         `json:"offset"`
+	Entries []entryInfo `json:"entries"`
+}
+
+type segmentUsage struct {
+	Entries int `json:"entries"`
+	Bytes   int `json:"bytes"`
+}
+
+type cacheSummary struct {
+	Hits        int64                   `json:"hits"`
+	Misses      int64                   `json:"misses"`
+	HitRatio    float64                 `json:"hit_ratio"`
+	Coalesced   int64                   `json:"coalesced"`
+	Evictions   int64                   `json:"evictions"`
+	Expirations int64                   `json:"expirations"`
+	Entries     int                     `json:"entries"`
+	Bytes       int                     `json:"bytes"`
+	Shards      int                     `json:"shards"`
+	Segments    map[string]segmentUsage `json:"segments"`
+}
+
+// Handles GET requests for a page of entries, at most limit of them starting offset entries in.
+func (cache *cache) ListKeys(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	offset, err := queryInt(query, "offset", 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	limit, err := queryInt(query, "limit", defaultListLimit)
+	if err == nil && (limit < 1 || limit > maxListLimit) {
+		err = fmt.Errorf("limit must be between 1 and %d", maxListLimit)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	encoding := query.Get("encoding")
+	if _, err := encodeKey("", encoding); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	list := cache.listEntries(offset, limit)
+	for i := range list.Entries {
+		list.Entries[i].Key, _ = encodeKey(list.Entries[i].Key, encoding)
+	}
+	writeJSON(w, list)
+}
+
+// Handles GET requests for a single key, describing its entry.
+func (cache *cache) InspectKey(w http.ResponseWriter, r *http.Request) {
+	key, err := requestKey(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	index := cache.shardIndex(key)
+	shard := cache.shards[index]
+	shard.mu.Lock()
+	n, ok := shard.key2ElementMap[key]
+	var info entryInfo
+	if ok {
+		info = cache.describe(n, index, time.Now())
+	}
+	shard.mu.Unlock()
+
+	if !ok {
+		http.Error(w, "key not cached", http.StatusNotFound)
+		return
+	}
+	info.Key, _ = encodeKey(key, r.URL.Query().Get("encoding"))
+	writeJSON(w, info)
+}
+
+// Handles GET requests for a summary of the cache.
+func (cache *cache) GetSummary(w http.ResponseWriter, r *http.Request) {
+	stats := cache.GetStats()
+	summary := cacheSummary{
+		Hits:        stats.Hits,
+		Misses:      stats.Misses,
+		Coalesced:   stats.Coalesced,
+		Evictions:   stats.Evictions,
+		Expirations: stats.Expirations,
+		Shards:      len(cache.shards),
+		Segments:    make(map[string]segmentUsage),
+	}
+	if lookups := stats.Hits + stats.Misses; lookups > 0 {
+		summary.HitRatio = float64(stats.Hits) / float64(lookups)
+	}
+
+	for _, shard := range cache.shards {
+		for i, usage := range shard.usage() {
+			name := cache.segmentName(i)
+			total := summary.Segments[name]
+			total.Entries += usage.Entries
+			total.Bytes += usage.Bytes
+			summary.Segments[name] = total
+
+			if i != negativeSegment {
+				summary.Entries += usage.Entries
+			}
+			summary.Bytes += usage.Bytes
+		}
+	}
+	writeJSON(w, summary)
+}
+
+// Returns up to limit entries, starting offset entries in, along with the number of entries in the cache. Segments
+// lying wholly before offset are skipped without walking them.
+func (cache *cache) listEntries(offset, limit int) entryList {
+	list := entryList{Offset: offset, Entries: []entryInfo{}}
+	now := time.Now()
+	skipped := 0
+	for i, shard := range cache.shards {
+		shard.mu.Lock()
+		list.Total += len(shard.key2ElementMap)
+		for _, segment := range shard.segments {
+			if len(list.Entries) == limit {
+				break
+			}
+			if skipped+segment.len <= offset {
+				skipped += segment.len
+				continue
+			}
+
+			segment.policy.each(func(n *node) bool {
+				if skipped < offset {
+					skipped++
+					return true
+				}
+				list.Entries = append(list.Entries, cache.describe(n, i, now))
+				return len(list.Entries) < limit
+			})
+		}
+		shard.mu.Unlock()
+	}
+	return list
+}
+
+// Describes the node, held in shard index i. The shard must be locked.
+func (cache *cache) describe(n *node, i int, now time.Time) entryInfo {
+	source := "redis"
+	if n.written {
+		source = "write"
+	}
+
+	lastRead := n.lastAccess
+	if lastRead.IsZero() {
+		lastRead = n.creationTime
+	}
+
+	return entryInfo{
+		Key:      n.key,
+		Shard:    i,
+		Segment:  cache.segmentName(n.segment),
+		Negative: n.negative,
+		Source:   source,
+		Age:      now.Sub(n.creationTime).Seconds(),
+		TTL:      n.expiresAt.Sub(now).Seconds(),
+		Idle:     now.Sub(lastRead).Seconds(),
+		Bytes:    n.size(),
+		Hits:     n.hits,
+	}
+}
+
+// Names a shard segment: "values", "negative", or the pattern of the cache rule whose keys it holds.
+func (cache *cache) segmentName(segment int) string {
+	switch segment {
+	case valuesSegment:
+		return "values"
+	case negativeSegment:
+		return "negative"
+	}
+	for _, rule := range cache.rules {
+		if rule.segment == segment {
+			return rule.pattern
+		}
+	}
+	return strconv.Itoa(segment)
+}
+
+// Returns the number of entries and bytes in each of the shard's segments.
+func (shard *shard) usage() []segmentUsage {
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	usage := make([]segmentUsage, len(shard.segments))
+	for i, segment := range shard.segments {
+		usage[i] = segmentUsage{Entries: segment.len, Bytes: segment.bytes}
+	}
+	return usage
+}
+
+// Reads an optional non-negative integer query parameter, falling back to defaultValue when it is not set.
+func queryInt(query url.Values, name string, defaultValue int) (int, error) {
+	raw := query.Get(name)
+	if raw == "" {
+		return defaultValue, nil
+	}
+
+	value, err := strconv.Atoi(raw)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative integer", name)
+	}
+	return value, nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Helper function that sends a GET request to an admin endpoint with the token, and decodes the JSON response into v.
+// Returns the status code.
+func inspectRequest(t *testing.T, cache *cache, target string, v interface{}) int {
+	res := routeRequest(cache, "GET", target, "", adminAuthorization...)
+	if res.Code == http.StatusOK {
+		if err := json.Unmarshal(res.Body.Bytes(), v); err != nil {
+			t.Fatalf("For %s, expected a JSON response, got %q", target, res.Body.String())
+		}
+	}
+	return res.Code
+}
+
+// Checks that entries are listed from the most to the least recently used, a page at a time.
+func TestInspectListsKeysInLRUOrder(t *testing.T) {
+	cache := newPolicyTestCache(10, newLRUPolicy)
+	for _, key := range []string{"k1", "k2", "k3", "k4", "k5", "k2"} {
+		readThrough(cache.shards[0], key)
+	}
+
+	pages := []struct {
+		target   string
+		expected []string
+	}{
+		{"/admin/keys", []string{"k2", "k5", "k4", "k3", "k1"}},
+		{"/admin/keys?limit=2", []string{"k2", "k5"}},
+		{"/admin/keys?offset=2&limit=2", []string{"k4", "k3"}},
+		{"/admin/keys?offset=4&limit=2", []string{"k1"}},
+		{"/admin/keys?offset=5", []string{}},
+		{"/admin/keys?limit=1&encoding=base64", []string{"azI="}},
+	}
+	for _, page := range pages {
+		var list entryList
+		if code := inspectRequest(t, cache, page.target, &list); code != http.StatusOK {
+			t.Fatalf("For %s, expected 200 OK, got %d", page.target, code)
+		}
+
+		var keys []string
+		for _, entry := range list.Entries {
+			keys = append(keys, entry.Key)
+		}
+		if list.Total != 5 || len(keys) != len(page.expected) {
+			t.Errorf("For %s, expected %v of 5 entries, got %v of %d", page.target, page.expected, keys, list.Total)
+			continue
+		}
+		for i := range keys {
+			if keys[i] != page.expected[i] {
+				t.Errorf("For %s, expected %v, got %v", page.target, page.expected, keys)
+				break
+			}
+		}
+	}
+
+	for _, target := range []string{"/admin/keys?limit=0", "/admin/keys?limit=1001", "/admin/keys?offset=-1",
+		"/admin/keys?encoding=hex"} {
+		if code := inspectRequest(t, cache, target, nil); code != http.StatusBadRequest {
+			t.Errorf("For %s, expected 400 Bad Request, got %d", target, code)
+		}
+	}
+}
+
+// Checks that an entry's metadata is described, without counting as a read of it.
+func TestInspectDescribesEntry(t *testing.T) {
+	cache := newPolicyTestCache(10, newLRUPolicy)
+	written := newNode("user:\xff", "value", time.Minute, valuesSegment)
+	written.written = true
+	cache.shards[0].put(written)
+	cache.shards[0].fetch("user:\xff")
+	cache.shards[0].fetch("user:\xff")
+	readThrough(cache.shards[0], "fetched")
+
+	for i := 0; i < 2; i++ {
+		var info entryInfo
+		if code := inspectRequest(t, cache, "/admin/keys/dXNlcjr_?encoding=base64url", &info); code != http.StatusOK {
+			t.Fatalf("Expected the entry to be described, got %d", code)
+		}
+		if info.Key != "dXNlcjr_" || info.Source != "write" || info.Hits != 2 || info.Bytes != written.size() {
+			t.Errorf("Expected the written entry with 2 hits and %d bytes, got %+v", written.size(), info)
+		}
+		if info.TTL <= 0 || info.TTL > 60 || info.Age < 0 || info.Idle > info.Age {
+			t.Errorf("Expected a fresh entry with up to a minute to live, got %+v", info)
+		}
+	}
+
+	var info entryInfo
+	inspectRequest(t, cache, "/admin/keys/fetched", &info)
+	if info.Source != "redis" || info.Segment != "values" || info.Negative {
+		t.Errorf("Expected a value fetched from Redis, got %+v", info)
+	}
+	if code := inspectRequest(t, cache, "/admin/keys/missing", nil); code != http.StatusNotFound {
+		t.Errorf("Expected keys that are not cached to get 404 Not Found, got %d", code)
+	}
+}
+
+// Checks that the summary counts lookups, and entries and bytes by segment.
+func TestInspectSummarizesCache(t *testing.T) {
+	limits := []segmentLimits{valuesSegment: {entries: 10}, negativeSegment: {entries: 10}}
+	cache := &cache{shards: []*shard{newShard(limits, newLRUPolicy)}}
+	for _, key := range []string{"k1", "k2", "k3"} {
+		readThrough(cache.shards[0], key)
+	}
+	cache.shards[0].put(newNegativeNode("missing", time.Minute))
+	cache.stats.Hits, cache.stats.Misses = 3, 1
+
+	var summary cacheSummary
+	if code := inspectRequest(t, cache, "/admin/stats", &summary); code != http.StatusOK {
+		t.Fatalf("Expected the summary to be served, got %d", code)
+	}
+	if summary.Hits != 3 || summary.Misses != 1 || summary.HitRatio != 0.75 {
+		t.Errorf("Expected 3 hits and 1 miss, got %+v", summary)
+	}
+	if summary.Entries != 3 || summary.Segments["values"].Entries != 3 || summary.Segments["negative"].Entries != 1 {
+		t.Errorf("Expected 3 values and 1 negative entry, got %+v", summary)
+	}
+	if summary.Bytes != cache.GetBytes() || summary.Shards != 1 {
+		t.Errorf("Expected %d bytes in 1 shard, got %+v", cache.GetBytes(), summary)
+	}
+
+	if res := routeRequest(cache, "GET", "/admin/stats", ""); res.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the summary to require the token, got %d", res.Code)
+	}
+}
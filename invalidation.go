@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+Writes made to Redis by other clients would go unnoticed until the cached values expire, unless Redis tells the cache
+about them. It can in two ways: keyspace notifications (see keyspace.go), or server-assisted client-side caching (see
+tracking.go). Either way, the cache keeps a connection of its own subscribed to messages naming keys that changed, and
+removes those keys from the cache as they arrive, so that the next read fetches the new value. Keys written through
+other proxies are received the same way, over the invalidation bus (see invalidationbus.go).
+
+Messages sent while the connection is down are lost. The listener therefore keeps its connection alive with pings,
+resubscribes when the connection fails, and then empties the cache, since any entry could have changed meanwhile.
+ */
+
+const (
+	invalidationPingInterval  = 5 * time.Second
+	invalidationRetryInterval = time.Second
+)
+
+// Where messages naming changed keys come from.
+type invalidationSource interface {
+	// Prepares a new connection of the listener's own and subscribes it to the messages.
+	subscribe(conn redis.Conn) error
+	// Removes the keys a message received on the channel names as changed from the cache.
+	invalidate(cache *cache, channel string, data interface{})
+	// Tells the source that the subscription was lost, and messages will be missed until it is renewed.
+	unsubscribed()
+	// Prepares the cache's pool, before it is used, if the source depends on its connections.
+	preparePool(pool *redis.Pool)
+}
+
+// Returns the named source of invalidations: "keyspace" for keyspace notifications, "tracking" for client tracking of
+// the keys the cache reads, or "bcast" for client tracking of all keys starting with one of the prefixes. An empty
+// name returns no source.
+func invalidationSourceByName(name string, prefixes []string) (invalidationSource, error) {
+	switch strings.ToLower(name) {
+	case "":
+		return nil, nil
+	case "keyspace":
+		return keyspaceNotifications{}, nil
+	case "tracking":
+		return newClientTracking(false, nil), nil
+	case "bcast":
+		return newClientTracking(true, prefixes), nil
+	}
+	return nil, fmt.Errorf("unknown invalidation %q, expected keyspace, tracking or bcast", name)
+}
+
+type invalidationListener struct {
+	source   invalidationSource
+	dial     func() (redis.Conn, error)
+	mu       sync.Mutex
+	conn     redis.Conn // The current subscription, closed to stop listening.
+	stopped  bool
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     sync.WaitGroup
+}
+
+// Removes keys from the cache as the source reports them changed in Redis. A nil source disables invalidation.
+func WithInvalidation(source invalidationSource) option {
+	return func(c *cache) {
+		c.invalidation = nil
+		if source != nil {
+			c.invalidation = &invalidationListener{source: source}
+		}
+	}
+}
+
+// Starts listening for changed keys on a dedicated connection made with dial in a goroutine, resubscribing whenever
+// the connection fails, until stopped.
+func (listener *invalidationListener) start(cache *cache, dial func() (redis.Conn, error)) {
+	listener.dial = dial
+	listener.source.preparePool(cache.pool)
+
+	listener.stop = make(chan struct{})
+	listener.done.Add(1)
+	go func() {
+		defer listener.done.Done()
+		for {
+			err := listener.listen(cache)
+			listener.source.unsubscribed()
+			select {
+			case <-listener.stop:
+				return
+			default:
+			}
+
+			log.Printf("Invalidation: %v, resubscribing in %v", err, invalidationRetryInterval)
+			select {
+			case <-time.After(invalidationRetryInterval):
+			case <-listener.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stops listening, and waits for the listening goroutine to exit.
+func (listener *invalidationListener) shutdown() {
+	listener.stopOnce.Do(func() {
+		close(listener.stop)
+		listener.mu.Lock()
+		listener.stopped = true
+		if listener.conn != nil {
+			listener.conn.Close()
+		}
+		listener.mu.Unlock()
+	})
+	listener.done.Wait()
+}
+
+// Subscribes to the source's messages and removes keys from the cache as they change, until the connection fails.
+func (listener *invalidationListener) listen(cache *cache) error {
+	conn, err := listener.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	listener.mu.Lock()
+	if listener.stopped {
+		listener.mu.Unlock()
+		return nil
+	}
+	listener.conn = conn
+	listener.mu.Unlock()
+
+	if err := listener.source.subscribe(conn); err != nil {
+		return err
+	}
+
+	// Ping the connection, so that a dead one is noticed by the ping going unanswered and the receive timing out.
+	quit := make(chan struct{})
+	defer close(quit)
+	go func() {
+		ticker := time.NewTicker(invalidationPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				conn.Send("PING")
+				if conn.Flush() != nil {
+					return
+				}
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	for {
+		// Messages are parsed here rather than by redis.PubSubConn, which can't parse client tracking's arrays of keys.
+		reply, err := redis.Values(redis.ReceiveWithTimeout(conn, 2*invalidationPingInterval))
+		if err != nil {
+			return err
+		}
+
+		var kind string
+		if _, err := redis.Scan(reply, &kind); err != nil {
+			return err
+		}
+
+		switch {
+		case (kind == "message" && len(reply) == 3) || (kind == "pmessage" && len(reply) == 4):
+			channel, err := redis.String(reply[len(reply)-2], nil)
+			if err != nil {
+				return err
+			}
+
+			listener.source.invalidate(cache, channel, reply[len(reply)-1])
+		case kind == "subscribe" || kind == "psubscribe":
+			// Keys may have changed while there was no subscription, with the messages lost.
+			dropped := cache.removeAll()
+			if dropped > 0 {
+				log.Printf("Invalidation: subscribed, dropped %d entries that may have changed meanwhile", dropped)
+			}
+		}
+	}
+}
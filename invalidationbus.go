@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/gomodule/redigo/redis"
+	"log"
+)
+
+/**
+Several proxies in front of one Redis each cache values of their own, so a write through one of them would leave the
+others serving the old value until it expires. With an invalidation bus, every proxy publishes the keys it writes,
+deletes or purges on a Redis pub/sub channel, and the others remove those keys from their caches as the messages
+arrive. Each proxy picks a random instance ID at startup and sends it with its messages, so that it can ignore its own.
+
+The bus is a source of invalidations like keyspace notifications (see invalidation.go), and is received the same way:
+a proxy whose subscription was down, and may have missed messages, empties its cache once subscribed again. Messages
+are JSON objects such as {"instance": "9f86d081884c7d65", "keys": ["dXNlcjox"]}, with the keys base64 encoded so that
+keys that are not valid text survive. Purges of all keys matching a glob pattern send the pattern, base64 encoded too,
+instead of keys, and purges of the whole cache send "all": true.
+ */
+
+type invalidationBus struct {
+	channel  string
+	instance string
+	pool     *redis.Pool
+	listener *invalidationListener
+}
+
+type invalidationMessage struct {
+	Instance string   `json:"instance"`
+	Keys     [][]byte `json:"keys,omitempty"`
+	Pattern  []byte   `json:"pattern,omitempty"`
+	All      bool     `json:"all,omitempty"`
+}
+
+// Publishes the keys written, deleted or purged through this proxy on the channel, and removes the keys other proxies
+// publish there from the cache. An empty channel disables the bus.
+func WithInvalidationBus(channel string) option {
+	return func(c *cache) {
+		c.bus = nil
+		if channel != "" {
+			c.bus = &invalidationBus{channel: channel, instance: newInstanceID()}
+			c.bus.listener = &invalidationListener{source: c.bus}
+		}
+	}
+}
+
+// Returns a random ID for this proxy, unique among the proxies publishing on a channel.
+func newInstanceID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		log.Fatal(err)
+	}
+	return hex.EncodeToString(id)
+}
+
+// Starts receiving other proxies' messages on a connection made with dial, and publishing over the pool.
+func (bus *invalidationBus) start(cache *cache, dial func() (redis.Conn, error)) {
+	bus.pool = cache.pool
+	bus.listener.start(cache, dial)
+}
+
+// Stops receiving other proxies' messages. Writes can still be published until the pool is closed.
+func (bus *invalidationBus) shutdown() {
+	bus.listener.shutdown()
+}
+
+// Tells the other proxies that the keys changed.
+func (bus *invalidationBus) publishKeys(keys []string) {
+	message := invalidationMessage{Keys: make([][]byte, len(keys))}
+	for i, key := range keys {
+		message.Keys[i] = []byte(key)
+	}
+	bus.publish(message)
+}
+
+// Tells the other proxies to remove all keys matching the glob pattern.
+func (bus *invalidationBus) publishPattern(pattern string) {
+	bus.publish(invalidationMessage{Pattern: []byte(pattern)})
+}
+
+// Tells the other proxies to empty their caches.
+func (bus *invalidationBus) publishAll() {
+	bus.publish(invalidationMessage{All: true})
+}
+
+// Publishes the message from this proxy. A failure to publish is logged rather than failing the write or purge the
+// message is about, which has already been made.
+func (bus *invalidationBus) publish(message invalidationMessage) {
+	message.Instance = bus.instance
+	data, err := json.Marshal(message)
+	if err == nil {
+		conn := bus.pool.Get()
+		_, err = conn.Do("PUBLISH", bus.channel, data)
+		conn.Close()
+	}
+	if err != nil {
+		log.Printf("Invalidation bus: failed to publish: %v", err)
+	}
+}
+
+// Subscribes to the channel.
+func (bus *invalidationBus) subscribe(conn redis.Conn) error {
+	conn.Send("SUBSCRIBE", bus.channel)
+	return conn.Flush()
+}
+
+// Removes what another proxy published as changed from the cache, ignoring this proxy's own messages.
+func (bus *invalidationBus) invalidate(cache *cache, channel string, data interface{}) {
+	raw, err := redis.Bytes(data, nil)
+	if channel != bus.channel || err != nil {
+		return
+	}
+
+	var message invalidationMessage
+	if err := json.Unmarshal(raw, &message); err != nil {
+		log.Printf("Invalidation bus: ignoring malformed message %q: %v", raw, err)
+		return
+	}
+
+	switch {
+	case message.Instance == bus.instance:
+	case message.All:
+		cache.removeAll()
+	case message.Pattern != nil:
+		cache.removeMatching(string(message.Pattern))
+	default:
+		for _, key := range message.Keys {
+			cache.invalidate(string(key))
+		}
+	}
+}
+
+func (bus *invalidationBus) unsubscribed() {}
+
+func (bus *invalidationBus) preparePool(pool *redis.Pool) {}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Helper function that waits up to a second for the proxies to receive messages on the channel, by publishing a
+// message naming a key cached in each of them until it is removed.
+func waitForBus(t *testing.T, channel string, caches ...*cache) {
+	message := `{"instance": "test", "keys": ["YnVzOnNlbnRpbmVs"]}`
+	deadline := time.Now().Add(time.Second)
+	for _, cache := range caches {
+		shard := cache.shardFor("bus:sentinel")
+		shard.put(newNode("bus:sentinel", "", time.Hour, valuesSegment))
+		for cacheHoldsKey(shard, "bus:sentinel") {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected the proxies to subscribe to %s", channel)
+			}
+			redisDirect.Do("PUBLISH", channel, message)
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+// Checks that keys written or deleted through one proxy are removed from the caches of the others, but not its own.
+func TestInvalidationBusRemovesKeysWrittenThroughOtherProxies(t *testing.T) {
+	writer := NewCache(redisServer, 10, 60, maxConnections, WithInvalidationBus("bus:test"))
+	defer writer.Close()
+	reader := NewCache(redisServer, 10, 60, maxConnections, WithInvalidationBus("bus:test"))
+	defer reader.Close()
+	waitForBus(t, "bus:test", writer, reader)
+
+	binaryKey := "bus:\xff\x00"
+	for _, key := range []string{"bus:k", binaryKey} {
+		writer.set(key, "old", setOptions{})
+		if value, _, _ := reader.get(key); value != "old" {
+			t.Fatalf("Expected %q to be cached as old, got %q", key, value)
+		}
+
+		writer.set(key, "new", setOptions{})
+		if !waitUntilDropped(reader, key) {
+			t.Errorf("Expected %q to be removed from the other proxy once written", key)
+		}
+		if !cacheHolds(writer, key, "new") {
+			t.Errorf("Expected %q to stay cached in the proxy that wrote it", key)
+		}
+	}
+
+	reader.get("bus:k")
+	writer.del([]string{"bus:k"})
+	if !waitUntilDropped(reader, "bus:k") {
+		t.Errorf("Expected the key to be removed from the other proxy once deleted")
+	}
+}
+
+// Checks that in write-behind mode, keys are published once written to Redis, not before.
+func TestInvalidationBusPublishesWritesBehindOnceFlushed(t *testing.T) {
+	writer := NewCache(redisServer, 10, 60, maxConnections,
+		WithInvalidationBus("bus:behind"), WithWriteBehind(100, 10, time.Hour))
+	reader := NewCache(redisServer, 10, 60, maxConnections, WithInvalidationBus("bus:behind"))
+	defer reader.Close()
+	waitForBus(t, "bus:behind", writer, reader)
+	redisDirect.Do("SET", "bus:behind", "old")
+
+	reader.get("bus:behind")
+	writer.set("bus:behind", "new", setOptions{})
+	if waitUntilDropped(reader, "bus:behind") {
+		t.Errorf("Expected the key not to be published before it was written to Redis")
+	}
+
+	writer.Close()
+	if !waitUntilDropped(reader, "bus:behind") {
+		t.Errorf("Expected the key to be published once written to Redis")
+	}
+	if value, _, _ := reader.get("bus:behind"); value != "new" {
+		t.Errorf("Expected the other proxy to fetch the new value, got %q", value)
+	}
+}
+
+// Checks that messages from this proxy, and malformed ones, are ignored.
+func TestInvalidationBusIgnoresOwnAndMalformedMessages(t *testing.T) {
+	bus := &invalidationBus{channel: "bus:c", instance: "self"}
+	cache := newPolicyTestCache(10, newLRUPolicy)
+	readThrough(cache.shards[0], "k")
+
+	bus.invalidate(cache, "bus:c", []byte(`{"instance": "self", "keys": ["aw=="]}`))
+	bus.invalidate(cache, "bus:c", []byte("{"))
+	bus.invalidate(cache, "bus:other", []byte(`{"instance": "other", "keys": ["aw=="]}`))
+	if !cacheHoldsKey(cache.shards[0], "k") {
+		t.Errorf("Expected own messages, malformed ones and other channels to be ignored")
+	}
+
+	bus.invalidate(cache, "bus:c", []byte(`{"instance": "other", "keys": ["aw=="]}`))
+	if cacheHoldsKey(cache.shards[0], "k") {
+		t.Errorf("Expected other proxies' messages to remove the key")
+	}
+}
+
+// Checks that purges through one proxy are passed on to the others.
+func TestInvalidationBusPassesOnPurges(t *testing.T) {
+	purger := NewCache(redisServer, 10, 60, maxConnections, WithInvalidationBus("bus:purge"))
+	defer purger.Close()
+	other := NewCache(redisServer, 10, 60, maxConnections, WithInvalidationBus("bus:purge"))
+	defer other.Close()
+	waitForBus(t, "bus:purge", purger, other)
+	redisDirect.Do("MSET", "purge:a:1", "v", "purge:b:1", "v", "purge:c:1", "v")
+
+	for _, key := range []string{"purge:a:1", "purge:b:1", "purge:c:1"} {
+		other.get(key)
+	}
+
+	purger.purgeKey("purge:a:1")
+	if !waitUntilDropped(other, "purge:a:1") {
+		t.Errorf("Expected the purged key to be removed from the other proxy")
+	}
+
+	purger.purgeMatching("purge:b:*")
+	if !waitUntilDropped(other, "purge:b:1") {
+		t.Errorf("Expected keys matching the purged pattern to be removed from the other proxy")
+	}
+	if !cacheHolds(other, "purge:c:1", "v") {
+		t.Errorf("Expected keys not matching the purged pattern to stay cached")
+	}
+
+	purger.purgeAll()
+	if !waitUntilDropped(other, "purge:c:1") {
+		t.Errorf("Expected the other proxy to be emptied")
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+/**
+The janitor actively removes expired entries in the background, the way Redis expires keys. Otherwise an expired entry
+is only removed when it is next looked up, and until then it takes up memory and capacity, causing live entries to be
+evicted in its place. Every interval, the janitor looks at a random sample of each shard's entries and removes those
+that have expired. If many in the sample had expired, there are likely more, so it samples the shard again, until few
+expired entries are found or the sweep runs out of time.
+ */
+
+const (
+	// Entries sampled per round at effort 1.
+	sweepSampleSize = 20
+	// A shard is sampled again while more than 1 in sweepRepeatRatio sampled entries had expired.
+	sweepRepeatRatio = 4
+	maxSweepEffort   = 10
+)
+
+type janitor struct {
+	interval time.Duration
+	effort   int
+	cursor   int // Shard the next sweep starts at, so that every shard gets its turn when sweeps run out of time.
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     sync.WaitGroup
+}
+
+// Removes expired entries in the background every interval. effort, from 1 to 10, scales how many entries are sampled
+// per round and how much of the interval a sweep may take, from a quarter of it at effort 1 to all of it from effort 4.
+func WithJanitor(interval time.Duration, effort int) option {
+	return func(c *cache) {
+		if interval <= 0 {
+			c.janitor = nil
+			return
+		}
+
+		if effort < 1 {
+			effort = 1
+		}
+		if effort > maxSweepEffort {
+			effort = maxSweepEffort
+		}
+		c.janitor = &janitor{interval: interval, effort: effort}
+	}
+}
+
+// Starts sweeping the cache's shards in a goroutine, until stopped.
+func (janitor *janitor) start(cache *cache) {
+	janitor.stop = make(chan struct{})
+	janitor.done.Add(1)
+	go func() {
+		defer janitor.done.Done()
+		ticker := time.NewTicker(janitor.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				janitor.sweep(cache.shards)
+			case <-janitor.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stops the janitor, and waits for a sweep in progress to finish.
+func (janitor *janitor) shutdown() {
+	janitor.stopOnce.Do(func() {
+		close(janitor.stop)
+	})
+	janitor.done.Wait()
+}
+
+// Samples each shard for expired entries and removes them, within the time allowed for a sweep. Returns the number of
+// entries removed.
+func (janitor *janitor) sweep(shards []*shard) int {
+	budget := janitor.interval * time.Duration(janitor.effort) / sweepRepeatRatio
+	if budget > janitor.interval {
+		budget = janitor.interval
+	}
+	deadline := time.Now().Add(budget)
+
+	removed := 0
+	for i := 0; i < len(shards); i++ {
+		shard := shards[janitor.cursor]
+		janitor.cursor = (janitor.cursor + 1) % len(shards)
+		for {
+			sampled, expired := shard.removeExpired(sweepSampleSize*janitor.effort, time.Now())
+			removed += expired
+			if expired*sweepRepeatRatio <= sampled || time.Now().After(deadline) {
+				break
+			}
+		}
+
+		if time.Now().After(deadline) {
+			break
+		}
+	}
+	return removed
+}
+
+// Looks at up to n entries of the shard and removes those that had expired by now and are past their stale windows.
+// Map iteration starts at a random position, which makes the entries a random sample. Returns how many entries were
+// looked at and how many removed.
+func (shard *shard) removeExpired(n int, now time.Time) (sampled, expired int) {
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	for _, curNode := range shard.key2ElementMap {
+		if sampled == n {
+			break
+		}
+
+		sampled++
+		if now.After(curNode.retainedUntil()) {
+			shard.removeNode(curNode)
+			shard.expirations++
+			expired++
+		}
+	}
+	return sampled, expired
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Checks that a sweep removes every expired entry of a shard and leaves live ones, repeating rounds while samples
+// keep finding expired entries.
+func TestJanitorSweepRemovesExpiredEntries(t *testing.T) {
+	cache := newPolicyTestCache(1000, newLRUPolicy)
+	shard := cache.shards[0]
+	for i := 0; i < 500; i++ {
+		shard.put(newNode(fmt.Sprintf("expired%d", i), "v", -time.Second, valuesSegment))
+	}
+	for i := 0; i < 10; i++ {
+		shard.put(newNode(fmt.Sprintf("live%d", i), "v", time.Hour, valuesSegment))
+	}
+
+	janitor := &janitor{interval: time.Second, effort: 1}
+	removed := janitor.sweep(cache.shards)
+	if removed < 400 || shard.size() != 510-removed {
+		t.Errorf("Expected most of 500 expired entries to be removed, removed %d leaving %d", removed, shard.size())
+	}
+
+	for janitor.sweep(cache.shards) > 0 {
+	}
+	if shard.size() != 10 {
+		t.Errorf("Expected only the 10 live entries to remain, got %d", shard.size())
+	}
+	checkListMatchesMap(t, cache)
+}
+
+// Checks that the janitor started by NewCache removes expired entries that are never looked up, and stops on Close.
+func TestCacheJanitorRunsInBackground(t *testing.T) {
+	cache := NewCache(redisServer, 100, 60, maxConnections, WithShards(4), WithJanitor(10*time.Millisecond, 1))
+	for i := 0; i < 50; i++ {
+		cache.putInCacheWithTTL(fmt.Sprintf("short%d", i), "v", 50*time.Millisecond)
+	}
+	cache.putInCache(k1, v1)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for cache.GetSize() > 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if cache.GetSize() != 1 || !cacheHolds(cache, k1, v1) {
+		t.Errorf("Expected the janitor to leave only the live entry, size is %d", cache.GetSize())
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		cache.Close()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatalf("Close did not stop the janitor")
+	}
+}
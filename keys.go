@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+/**
+HTTP requests can name the key to look up in three ways: in the path, as in GET /keys/user%3A42, in the query, as in
+GET /?key=user%3A42, or in the key header, as in the original API. Path and query keys are URL decoded, so any key can
+be addressed, including ones with slashes or characters that are not allowed in headers. Keys that are not valid text
+can be sent base64 encoded, with encoding=base64 (standard alphabet) or encoding=base64url (URL-safe alphabet, padding
+optional) in the query.
+ */
+
+// Returns the key a request is for, taken from the path, the query or the header, in that order.
+func requestKey(r *http.Request) (string, error) {
+	query := r.URL.Query()
+	var key string
+	if escaped, ok := mux.Vars(r)["key"]; ok {
+		// The router matches on the still encoded path, so that encoded slashes are part of the key.
+		unescaped, err := url.PathUnescape(escaped)
+		if err != nil {
+			return "", err
+		}
+		key = unescaped
+	} else if values, ok := query["key"]; ok {
+		key = values[0]
+	} else {
+		key = r.Header.Get("key")
+	}
+	return decodeKey(key, query.Get("encoding"))
+}
+
+// Decodes a key sent in the given encoding, "" meaning it was sent as is.
+func decodeKey(key, encoding string) (string, error) {
+	var decoded []byte
+	var err error
+	switch encoding {
+	case "":
+		return key, nil
+	case "base64":
+		decoded, err = base64.StdEncoding.DecodeString(key)
+	case "base64url":
+		decoded, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(key, "="))
+	default:
+		return "", fmt.Errorf("unknown key encoding %q, expected base64 or base64url", encoding)
+	}
+
+	if err != nil {
+		return "", errors.New("key is not valid " + encoding)
+	}
+	return string(decoded), nil
+}
+
+// Encodes a key to be sent back in the given encoding, "" meaning as is, the reverse of decodeKey.
+func encodeKey(key, encoding string) (string, error) {
+	switch encoding {
+	case "":
+		return key, nil
+	case "base64":
+		return base64.StdEncoding.EncodeToString([]byte(key)), nil
+	case "base64url":
+		return base64.RawURLEncoding.EncodeToString([]byte(key)), nil
+	}
+	return "", fmt.Errorf("unknown key encoding %q, expected base64 or base64url", encoding)
+}
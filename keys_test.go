@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Token the router of routeRequest requires for admin endpoints, and the header sending it.
+const testAdminToken = "secret"
+
+var adminAuthorization = []string{"Authorization", "Bearer " + testAdminToken}
+
+// Helper function that serves a request through the router, so that keys are read from the path as in production.
+// headers holds the names and values of headers to send, in pairs.
+func routeRequest(cache *cache, method, target, body string, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Add(headers[i], headers[i+1])
+	}
+	res := httptest.NewRecorder()
+	newRouter(cache, testAdminToken).ServeHTTP(res, req)
+	return res
+}
+
+// Checks that keys can be addressed by path, query and header, URL decoded, including keys with slashes and dots.
+func TestRouterAddressesKeysByPathQueryAndHeader(t *testing.T) {
+	cache := NewCache(redisServer, 10, 60, maxConnections)
+	defer cache.Close()
+	redisDirect.Do("SET", "rest/a b", "spaced")
+	redisDirect.Do("SET", "rest/../dots", "dotted")
+	redisDirect.Do("SET", "rest:plain", "plain")
+
+	targets := map[string]string{
+		"/keys/rest%2Fa%20b":     "spaced",
+		"/keys/rest/a%20b":       "spaced",
+		"/keys/rest/../dots":     "dotted",
+		"/keys/rest:plain":       "plain",
+		"/?key=rest%2Fa+b":       "spaced",
+		"/?key=rest%2F..%2Fdots": "dotted",
+	}
+	for target, expected := range targets {
+		if res := routeRequest(cache, "GET", target, ""); res.Code != http.StatusOK || res.Body.String() != expected {
+			t.Errorf("For %s, expected %q but got %d %q", target, expected, res.Code, res.Body.String())
+		}
+	}
+
+	if res := routeRequest(cache, "GET", "/", "", "key", "rest:plain"); res.Body.String() != "plain" {
+		t.Errorf("Expected the header key to still work, got %d %q", res.Code, res.Body.String())
+	}
+
+	if res := routeRequest(cache, "GET", "/?key=", ""); res.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an empty key, got %d", res.Code)
+	}
+}
+
+// Checks that binary keys can be sent base64 encoded, in the path, the query and batch lookups.
+func TestRouterDecodesBase64Keys(t *testing.T) {
+	cache := NewCache(redisServer, 10, 60, maxConnections)
+	defer cache.Close()
+	binaryKey := "bin\x00\xff/+"
+	redisDirect.Do("SET", binaryKey, "binary")
+
+	std := base64.StdEncoding.EncodeToString([]byte(binaryKey))
+	urlSafe := base64.RawURLEncoding.EncodeToString([]byte(binaryKey))
+	targets := []string{
+		"/keys/" + strings.Replace(std, "/", "%2F", -1) + "?encoding=base64",
+		"/keys/" + urlSafe + "?encoding=base64url",
+		"/?key=" + urlSafe + "%3D&encoding=base64url",
+	}
+	for _, target := range targets {
+		if res := routeRequest(cache, "GET", target, ""); res.Code != http.StatusOK || res.Body.String() != "binary" {
+			t.Errorf("For %s, expected binary but got %d %q", target, res.Code, res.Body.String())
+		}
+	}
+
+	res := routeRequest(cache, "POST", "/batch?encoding=base64url", `["`+urlSafe+`"]`)
+	if res.Code != http.StatusOK || res.Body.String() != `{"`+urlSafe+`":"binary"}`+"\n" {
+		t.Errorf("Expected the batch to map the encoded key to its value, got %d %s", res.Code, res.Body.String())
+	}
+
+	for _, target := range []string{"/keys/not-base64!?encoding=base64", "/keys/k1?encoding=rot13"} {
+		if res := routeRequest(cache, "GET", target, ""); res.Code != http.StatusBadRequest {
+			t.Errorf("For %s, expected 400 but got %d", target, res.Code)
+		}
+	}
+}
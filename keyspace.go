@@ -0,0 +1,32 @@
+package main
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"strings"
+)
+
+/**
+Keyspace notifications are one source of invalidations (see invalidation.go). Redis publishes an event on the channel
+__keyspace@<db>__:<key> whenever a key is set, deleted, expired, evicted or otherwise changed, for every key and to
+every subscriber. Redis only publishes them if notify-keyspace-events is configured to, for example to "KA".
+ */
+
+// The proxy only reads database 0, which is the one its connections select.
+const keyspaceChannelPrefix = "__keyspace@0__:"
+
+type keyspaceNotifications struct{}
+
+// Subscribes to keyspace notifications for all keys.
+func (keyspaceNotifications) subscribe(conn redis.Conn) error {
+	conn.Send("PSUBSCRIBE", keyspaceChannelPrefix+"*")
+	return conn.Flush()
+}
+
+// Removes the key named by the channel. Every event means the key changed, so the event itself is not looked at.
+func (keyspaceNotifications) invalidate(cache *cache, channel string, data interface{}) {
+	cache.invalidate(strings.TrimPrefix(channel, keyspaceChannelPrefix))
+}
+
+func (keyspaceNotifications) unsubscribed() {}
+
+func (keyspaceNotifications) preparePool(pool *redis.Pool) {}
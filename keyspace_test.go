@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Helper function that publishes a keyspace notification for the key until the cache drops it, as the listener may not
+// have subscribed yet. Returns whether the key was dropped within a second.
+func notifyUntilDropped(cache *cache, key string) bool {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		redisDirect.Do("PUBLISH", keyspaceChannelPrefix+key, "set")
+		time.Sleep(10 * time.Millisecond)
+		if _, status := cache.fetchFromCache(key); status == statusMiss {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks that keys are removed from the cache as Redis reports them changed.
+func TestKeyspaceNotificationsRemoveChangedKeys(t *testing.T) {
+	cache := NewCache(redisServer, 10, 60, maxConnections, WithInvalidation(keyspaceNotifications{}))
+	defer cache.Close()
+	redisDirect.Do("SET", "keyspace:changed", "old")
+	redisDirect.Do("SET", "keyspace:unchanged", "v")
+
+	cache.get("keyspace:changed")
+	if !notifyUntilDropped(cache, "keyspace:changed") {
+		t.Fatalf("Expected the listener to subscribe")
+	}
+
+	cache.get("keyspace:changed")
+	cache.get("keyspace:unchanged")
+	redisDirect.Do("PUBLISH", keyspaceChannelPrefix+"keyspace:changed", "set")
+	if !waitUntilDropped(cache, "keyspace:changed") {
+		t.Fatalf("Expected the changed key to be removed from the cache")
+	}
+	if !cacheHolds(cache, "keyspace:unchanged", "v") {
+		t.Errorf("Expected other keys to stay cached")
+	}
+
+	redisDirect.Do("SET", "keyspace:changed", "new")
+	if value, _, _ := cache.get("keyspace:changed"); value != "new" {
+		t.Errorf("Expected the new value to be fetched, got %q", value)
+	}
+}
+
+// Checks that a fetch in flight when its key changes does not cache the value it fetched.
+func TestKeyspaceNotificationsDiscardFetchesInFlight(t *testing.T) {
+	cache := NewCache(redisServer, 10, 60, maxConnections)
+	defer cache.Close()
+
+	version := cache.shardFor("keyspace:k").begin("keyspace:k")
+	cache.invalidate("keyspace:k")
+	cache.shardFor("keyspace:k").fill("keyspace:k", newNode("keyspace:k", "old", time.Minute, valuesSegment), version)
+	if _, status := cache.fetchFromCache("keyspace:k"); status != statusMiss {
+		t.Errorf("Expected the value fetched before the change not to be cached")
+	}
+
+	// Events for keys that are neither cached nor being fetched, here one in the same shard, leave the fetch alone.
+	shard := cache.shardFor("keyspace:k")
+	other := "keyspace:other"
+	for i := 0; cache.shardFor(other) != shard; i++ {
+		other = fmt.Sprintf("keyspace:other%d", i)
+	}
+	version = shard.begin("keyspace:k")
+	cache.invalidate(other)
+	shard.fill("keyspace:k", newNode("keyspace:k", "new", time.Minute, valuesSegment), version)
+	if !cacheHolds(cache, "keyspace:k", "new") {
+		t.Errorf("Expected events for other keys not to discard the fetch")
+	}
+	if len(shard.inFlight) != 0 {
+		t.Errorf("Expected no fetch to be tracked once done, got %v", shard.inFlight)
+	}
+}
+
+// Checks that the listener resubscribes when its connection fails, and then empties the cache, since notifications
+// may have been missed.
+func TestKeyspaceNotificationsResubscribeAndFlush(t *testing.T) {
+	cache := NewCache(redisServer, 10, 60, maxConnections, WithInvalidation(keyspaceNotifications{}))
+	defer cache.Close()
+	redisDirect.Do("SET", "keyspace:a", "v")
+	redisDirect.Do("SET", "keyspace:b", "v")
+
+	cache.get("keyspace:a")
+	if !notifyUntilDropped(cache, "keyspace:a") {
+		t.Fatalf("Expected the listener to subscribe")
+	}
+
+	cache.get("keyspace:b")
+	cache.invalidation.mu.Lock()
+	cache.invalidation.conn.Close()
+	cache.invalidation.mu.Unlock()
+
+	deadline := time.Now().Add(3 * invalidationRetryInterval)
+	for cacheHolds(cache, "keyspace:b", "v") {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the cache to be emptied once resubscribed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cache.get("keyspace:a")
+	if !notifyUntilDropped(cache, "keyspace:a") {
+		t.Errorf("Expected notifications to be received again once resubscribed")
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import "sort"
+
+// Least frequently used: entries are grouped in lists by how often they have been read since they were cached, and
+// evicted from the least frequently used group, least recently used first. All operations are constant time, except
+// finding the new lowest frequency after the last entry of the lowest group is removed other than by eviction.
+type lfuPolicy struct {
+	buckets map[int]*nodeList // Nodes with each access frequency, most recently used first.
+	minFreq int
+}
+
+func newLFUPolicy(capacity int) evictionPolicy {
+	return &lfuPolicy{buckets: make(map[int]*nodeList)}
+}
+
+func (policy *lfuPolicy) bucket(freq int) *nodeList {
+	bucket, ok := policy.buckets[freq]
+	if !ok {
+		bucket = new(nodeList)
+		policy.buckets[freq] = bucket
+	}
+	return bucket
+}
+
+// Takes a node out of its frequency bucket, dropping the bucket if it is left empty.
+func (policy *lfuPolicy) unlink(n *node) {
+	bucket := policy.buckets[n.freq]
+	bucket.removeNodeFromList(n)
+	if bucket.len == 0 {
+		delete(policy.buckets, n.freq)
+	}
+}
+
+func (policy *lfuPolicy) add(n *node) {
+	n.freq = 1
+	policy.bucket(1).insertNodeAtListFront(n)
+	policy.minFreq = 1
+}
+
+func (policy *lfuPolicy) touch(n *node) {
+	policy.unlink(n)
+	if n.freq == policy.minFreq && policy.buckets[n.freq] == nil {
+		policy.minFreq++
+	}
+
+	n.freq++
+	policy.bucket(n.freq).insertNodeAtListFront(n)
+}
+
+func (policy *lfuPolicy) remove(n *node) {
+	policy.unlink(n)
+}
+
+func (policy *lfuPolicy) evict() *node {
+	if policy.buckets[policy.minFreq] == nil {
+		policy.minFreq = 0
+		for freq := range policy.buckets {
+			if policy.minFreq == 0 || freq < policy.minFreq {
+				policy.minFreq = freq
+			}
+		}
+	}
+
+	victim := policy.buckets[policy.minFreq].tail
+	policy.unlink(victim)
+	return victim
+}
+
+func (policy *lfuPolicy) each(fn func(n *node) bool) {
+	freqs := make([]int, 0, len(policy.buckets))
+	for freq := range policy.buckets {
+		freqs = append(freqs, freq)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(freqs)))
+
+	for _, freq := range freqs {
+		if !policy.buckets[freq].each(fn) {
+			return
+		}
+	}
+}
@@ -1,17 +1,27 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/gorilla/mux"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
 /**
 This file boots up the HTTP service and is the starting point for running the application.
  */
+
+// How long requests being served when the service is stopped are given to finish, leaving time for pending writes to
+// be flushed before docker stop kills the service, 10 seconds after asking it to stop.
+const shutdownTimeout = 5 * time.Second
+
 func main() {
 	// Extract environment variables, set via Dockerfile.
 	redisServer := os.Getenv("redisServer")
@@ -35,19 +45,178 @@ func main() {
 		log.Fatal("Max connections must be an integer value")
 	}
 
-	// Initialize the cache, and defer closing its Redis connection when the service is stopped.
-	cache := NewCache(redisServer, capacity, expiryTime, maxConnections)
-	defer cache.Close()
+	// Optional: token required by the admin endpoints, as a bearer token. Left unset, they are not served.
+	adminToken := os.Getenv("adminToken")
+
+	// Optional: port for the Redis protocol front-end. Left unset, only the HTTP service is started.
+	respPort := optionalIntEnv("respPort", 0)
+	respPassword := os.Getenv("respPassword")
+
+	// Optional: number of independently locked shards to split the cache into. Defaults to a single shard.
+	shardCount := optionalIntEnv("shardCount", 1)
+
+	// Optional: how long, and how many, keys missing from Redis are cached as missing. Disabled unless both are set.
+	negativeExpiryTime := optionalIntEnv("negativeExpiryTime", 0)
+	negativeCapacity := optionalIntEnv("negativeCapacity", 0)
+
+	// Optional: per-namespace caching policies, such as "session:*=nocache; feed:*=ttl:5s,max:1000". See rules.go.
+	rules, rulesErr := parseCacheRules(os.Getenv("cacheRules"))
+	if rulesErr != nil {
+		log.Fatal(rulesErr)
+	}
+
+	// Optional: how many seconds after expiring values are still served, while they are refreshed in the background, and
+	// when Redis fails. Both default to 0, meaning expired values are never served.
+	staleWhileRevalidate := optionalIntEnv("staleWhileRevalidate", 0)
+	staleIfError := optionalIntEnv("staleIfError", 0)
+
+	// Optional: refresh values read at least refreshAheadHits times once they are within the last refreshAhead percent of
+	// their time in the cache. 0 disables it.
+	refreshAhead := optionalIntEnv("refreshAhead", 0)
+	refreshAheadHits := optionalIntEnv("refreshAheadHits", 1)
+
+	// Optional: with writeBehindInterval set, SETs are cached right away and written to Redis in the background, in
+	// batches of up to writeBehindBatch every writeBehindInterval milliseconds, with at most writeBehindQueue keys
+	// waiting. Left at 0, SETs are written through to Redis before they are acknowledged.
+	writeBehindInterval := optionalIntEnv("writeBehindInterval", 0)
+	writeBehindBatch := optionalIntEnv("writeBehindBatch", 100)
+	writeBehindQueue := optionalIntEnv("writeBehindQueue", 10000)
+
+	// Optional: how the cache learns of keys changed in Redis by other clients. Left unset, it doesn't, and entries are
+	// only refreshed once they expire. "keyspace" listens to keyspace notifications, which Redis must be configured to
+	// publish. "tracking" has Redis 6 track the keys the cache reads, and "bcast" all keys starting with one of the
+	// comma separated trackingPrefixes.
+	invalidation, invalidationErr := invalidationSourceByName(os.Getenv("invalidation"),
+		strings.FieldsFunc(os.Getenv("trackingPrefixes"), func(r rune) bool { return r == ',' || r == ' ' }))
+	if invalidationErr != nil {
+		log.Fatal(invalidationErr)
+	}
+
+	// Optional: Redis pub/sub channel on which proxies sharing a Redis tell each other of the keys written through them.
+	// Left unset, writes through other proxies go unnoticed until entries expire.
+	invalidationChannel := os.Getenv("invalidationChannel")
+
+	// Optional: memory budget for cached values in bytes, and the size above which values are not cached. With
+	// maxBytes set, a capacity of 0 limits the cache by bytes alone. Both default to 0, meaning no limit.
+	maxBytes := optionalIntEnv("maxBytes", 0)
+	maxValueBytes := optionalIntEnv("maxValueBytes", 0)
+
+	// Optional: how often, in milliseconds, expired entries are swept from the cache in the background, and how hard
+	// each sweep tries, from 1 to 10. A sweepInterval of 0 leaves expired entries to be removed when next looked up.
+	sweepInterval := optionalIntEnv("sweepInterval", 100)
+	sweepEffort := optionalIntEnv("sweepEffort", 1)
+
+	// Optional: which entries to evict when the cache is full: lru (the default), lfu, arc, tinylfu or s3fifo.
+	evictionPolicy := os.Getenv("evictionPolicy")
+	if evictionPolicy == "" {
+		evictionPolicy = "lru"
+	}
+	newPolicy, policyErr := evictionPolicyByName(evictionPolicy)
+	if policyErr != nil {
+		log.Fatal(policyErr)
+	}
+
+	// Initialize the cache. It is closed once the service has stopped serving, flushing pending writes to Redis.
+	cache := NewCache(redisServer, capacity, expiryTime, maxConnections,
+		WithShards(shardCount),
+		WithNegativeCaching(time.Duration(negativeExpiryTime)*time.Second, negativeCapacity),
+		WithRules(rules),
+		WithStaleWhileRevalidate(time.Duration(staleWhileRevalidate)*time.Second),
+		WithStaleIfError(time.Duration(staleIfError)*time.Second),
+		WithRefreshAhead(float64(refreshAhead)/100, refreshAheadHits),
+		WithMaxBytes(maxBytes),
+		WithMaxValueBytes(maxValueBytes),
+		WithEvictionPolicy(newPolicy),
+		WithJanitor(time.Duration(sweepInterval)*time.Millisecond, sweepEffort),
+		WithWriteBehind(writeBehindQueue, writeBehindBatch, time.Duration(writeBehindInterval)*time.Millisecond),
+		WithInvalidation(invalidation),
+		WithInvalidationBus(invalidationChannel))
 
-	// Set the handler for GET requests to the GetValue function in cache.
-	router := mux.NewRouter()
-	router.HandleFunc("/", cache.GetValue).Methods("GET")
+	// Either server failing to listen stops the service.
+	serveErrs := make(chan error, 2)
+
+	// Serve Redis clients such as redis-cli on the RESP port, in the background alongside the HTTP service. If a password
+	// is set, clients must authenticate with AUTH or HELLO first.
+	var respServer *respServer
+	if respPort > 0 {
+		respServer = NewRESPServer(cache, respPassword)
+		go func() {
+			serveErrs <- respServer.ListenAndServe(fmt.Sprintf(":%d", respPort))
+		}()
+	}
 
 	// Set up the HTTP service to listen at localhost at the user-configured port.
-	hostAddress := fmt.Sprintf(":%d", localhostPort)
-	log.Fatal(http.ListenAndServe(hostAddress, router))
+	server := &http.Server{Addr: fmt.Sprintf(":%d", localhostPort), Handler: newRouter(cache, adminToken)}
+	go func() {
+		serveErrs <- server.ListenAndServe()
+	}()
+
+	// Serve until stopped with SIGINT or SIGTERM, as docker stop does, then let the HTTP requests being served finish,
+	// disconnect RESP clients, and close the cache.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	var serveErr error
+	select {
+	case sig := <-signals:
+		log.Printf("Received %v, shutting down", sig)
+	case serveErr = <-serveErrs:
+		log.Print(serveErr)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("HTTP requests still being served on shutdown: %v", err)
+	}
+	if respServer != nil {
+		respServer.Close()
+	}
+	cache.Close()
+
+	if serveErr != nil {
+		os.Exit(1)
+	}
 }
 
+// Routes GET, PUT and DELETE requests for a key, named in the path, query or header, to the GetValue, SetValue and
+// DeleteValue functions in cache, batch lookups to GetValues, and /metrics to GetMetrics. Paths are matched as sent,
+// neither decoded nor cleaned, so that keys in them can hold encoded slashes and dots. Admin endpoints are only routed
+// if adminToken is set, and require it.
+func newRouter(cache *cache, adminToken string) *mux.Router {
+	router := mux.NewRouter().UseEncodedPath().SkipClean(true)
+	for _, path := range []string{"/", "/keys/{key:.+}"} {
+		router.HandleFunc(path, cache.GetValue).Methods("GET")
+		router.HandleFunc(path, cache.SetValue).Methods("PUT")
+		router.HandleFunc(path, cache.DeleteValue).Methods("DELETE")
+	}
+	router.HandleFunc("/batch", cache.GetValues).Methods("POST")
+	router.HandleFunc("/metrics", cache.GetMetrics).Methods("GET")
+	if adminToken != "" {
+		router.HandleFunc("/admin/keys/{key:.+}", requireAdminToken(adminToken, cache.PurgeKey)).Methods("DELETE")
+		router.HandleFunc("/admin/keys", requireAdminToken(adminToken, cache.PurgeKeys)).Methods("DELETE")
+		router.HandleFunc("/admin/keys/{key:.+}", requireAdminToken(adminToken, cache.InspectKey)).Methods("GET")
+		router.HandleFunc("/admin/keys", requireAdminToken(adminToken, cache.ListKeys)).Methods("GET")
+		router.HandleFunc("/admin/stats", requireAdminToken(adminToken, cache.GetSummary)).Methods("GET")
+	}
 
+	// Count every response, including those to requests that match no route.
+	router.Use(cache.countResponses)
+	router.NotFoundHandler = cache.countResponses(http.NotFoundHandler())
+	methodNotAllowed := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusMethodNotAllowed) }
+	router.MethodNotAllowedHandler = cache.countResponses(http.HandlerFunc(methodNotAllowed))
+	return router
+}
 
+// Reads an optional integer environment variable, falling back to defaultValue when it is not set.
+func optionalIntEnv(name string, defaultValue int) int {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return defaultValue
+	}
 
+	value, err := strconv.Atoi(raw)
+	if err != nil {
+		log.Fatalf("%s must be an integer value", name)
+	}
+	return value
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+GET /metrics serves the proxy's metrics in the Prometheus text format, for Prometheus to scrape:
+  redisproxy_cache_hits_total, _misses_total   lookups answered from the cache, and those that went to Redis
+  redisproxy_cache_coalesced_total             misses that shared another request's Redis fetch
+  redisproxy_cache_evictions_total             entries evicted to make room for others
+  redisproxy_cache_expirations_total           entries removed once expired
+  redisproxy_cache_entries, _bytes             values cached now, and the approximate memory used by all entries
+  redisproxy_redis_command_duration_seconds    histogram of Redis command latencies, by command
+  redisproxy_redis_command_errors_total        Redis commands that failed, by command
+  redisproxy_redis_pool_connections            pool connections, by state: in use or idle
+  redisproxy_http_requests_total               HTTP requests served, by method and status code, with methods other than
+                                               GET, PUT, DELETE, POST, HEAD and OPTIONS counted as "other"
+Redis commands are timed on the pool's connections, from when they are sent until their replies are read, so pipelined
+commands include the time spent waiting for the replies before them. The connections the cache keeps subscribed for
+invalidations are not timed. The format is simple enough to write by hand, which keeps the proxy free of a client
+library.
+ */
+
+// Upper bounds of the Redis command latency histogram's buckets, in seconds.
+var latencyBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5}
+
+// Metrics the cache records besides its stats. Safe for concurrent use; the zero value is ready to record.
+type metrics struct {
+	mu        sync.Mutex
+	commands  map[string]*latencyHistogram
+	responses map[responseLabels]int64
+}
+
+// Latencies of one Redis command. counts holds the number of observations in each bucket, not cumulative, with a
+// last one for those above all of latencyBuckets.
+type latencyHistogram struct {
+	counts []int64
+	sum    float64
+	errors int64
+}
+
+type responseLabels struct {
+	method string
+	code   int
+}
+
+// Records that a Redis command took elapsed, and whether it failed.
+func (metrics *metrics) observeCommand(command string, elapsed time.Duration, err error) {
+	command = strings.ToUpper(command)
+	seconds := elapsed.Seconds()
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	if metrics.commands == nil {
+		metrics.commands = make(map[string]*latencyHistogram)
+	}
+	histogram, ok := metrics.commands[command]
+	if !ok {
+		histogram = &latencyHistogram{counts: make([]int64, len(latencyBuckets)+1)}
+		metrics.commands[command] = histogram
+	}
+	histogram.counts[sort.SearchFloat64s(latencyBuckets, seconds)]++
+	histogram.sum += seconds
+	if err != nil {
+		histogram.errors++
+	}
+}
+
+// Returns copies of the recorded command latencies and response counts, so that they can be written out without
+// holding up the requests recording more.
+func (metrics *metrics) snapshot() (map[string]latencyHistogram, map[responseLabels]int64) {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	commands := make(map[string]latencyHistogram, len(metrics.commands))
+	for command, histogram := range metrics.commands {
+		copied := *histogram
+		copied.counts = append([]int64(nil), histogram.counts...)
+		commands[command] = copied
+	}
+	responses := make(map[responseLabels]int64, len(metrics.responses))
+	for labels, count := range metrics.responses {
+		responses[labels] = count
+	}
+	return commands, responses
+}
+
+// Methods responses are counted under. Clients may send any other token as a method, so those are all counted as
+// "other", keeping the number of series bounded.
+var countedMethods = map[string]bool{"GET": true, "PUT": true, "DELETE": true, "POST": true, "HEAD": true,
+	"OPTIONS": true}
+
+// Records that an HTTP request was answered with the status code.
+func (metrics *metrics) observeResponse(method string, code int) {
+	if !countedMethods[method] {
+		method = "other"
+	}
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	if metrics.responses == nil {
+		metrics.responses = make(map[responseLabels]int64)
+	}
+	metrics.responses[responseLabels{method, code}]++
+}
+
+// A pool connection that times the commands sent over it. pending holds the commands sent and not yet received, in
+// order, with the time each was sent.
+type timedConn struct {
+	redis.Conn
+	metrics *metrics
+	pending []sentCommand
+}
+
+type sentCommand struct {
+	command string
+	sent    time.Time
+}
+
+// Returns a dial function for the pool that times the commands sent over the connections dial makes.
+func (metrics *metrics) timedDial(dial func() (redis.Conn, error)) func() (redis.Conn, error) {
+	return func() (redis.Conn, error) {
+		conn, err := dial()
+		if err != nil {
+			return nil, err
+		}
+		return &timedConn{Conn: conn, metrics: metrics}, nil
+	}
+}
+
+func (conn *timedConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	return conn.do(cmd, func() (interface{}, error) { return conn.Conn.Do(cmd, args...) })
+}
+
+// Times commands run with redis.DoWithTimeout as it times Do. Without it and ReceiveWithTimeout, timing a connection
+// would hide the wrapped connection's redis.ConnWithTimeout, and calls with timeouts would fail.
+func (conn *timedConn) DoWithTimeout(timeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+	return conn.do(cmd, func() (interface{}, error) {
+		return redis.DoWithTimeout(conn.Conn, timeout, cmd, args...)
+	})
+}
+
+func (conn *timedConn) Send(cmd string, args ...interface{}) error {
+	err := conn.Conn.Send(cmd, args...)
+	if err == nil {
+		conn.pending = append(conn.pending, sentCommand{cmd, time.Now()})
+	}
+	return err
+}
+
+func (conn *timedConn) Receive() (interface{}, error) {
+	return conn.receive(conn.Conn.Receive)
+}
+
+func (conn *timedConn) ReceiveWithTimeout(timeout time.Duration) (interface{}, error) {
+	return conn.receive(func() (interface{}, error) { return redis.ReceiveWithTimeout(conn.Conn, timeout) })
+}
+
+// Times a Do. Do also reads the replies to all commands sent before it, which are timed as completing with it. An
+// empty command only does that, and is not timed itself.
+func (conn *timedConn) do(cmd string, do func() (interface{}, error)) (interface{}, error) {
+	start := time.Now()
+	reply, err := do()
+	now := time.Now()
+	for _, sent := range conn.pending {
+		conn.metrics.observeCommand(sent.command, now.Sub(sent.sent), nil)
+	}
+	conn.pending = conn.pending[:0]
+	if cmd != "" {
+		conn.metrics.observeCommand(cmd, now.Sub(start), err)
+	}
+	return reply, err
+}
+
+// Times the oldest command sent as completing with its reply.
+func (conn *timedConn) receive(receive func() (interface{}, error)) (interface{}, error) {
+	reply, err := receive()
+	if len(conn.pending) > 0 {
+		sent := conn.pending[0]
+		conn.pending = conn.pending[1:]
+		conn.metrics.observeCommand(sent.command, time.Since(sent.sent), err)
+	}
+	return reply, err
+}
+
+// Wraps every handler of the router to count the requests it answers, by method and status code.
+func (cache *cache) countResponses(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		handler.ServeHTTP(recorder, r)
+		cache.metrics.observeResponse(r.Method, recorder.code)
+	})
+}
+
+// Remembers the status code written to the response, which is 200 OK unless WriteHeader is called with another.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (recorder *statusRecorder) WriteHeader(code int) {
+	recorder.code = code
+	recorder.ResponseWriter.WriteHeader(code)
+}
+
+// Handles GET requests for the metrics, writing them in the Prometheus text format.
+func (cache *cache) GetMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	stats := cache.GetStats()
+	writeMetric(w, "redisproxy_cache_hits_total", "counter",
+		"Lookups answered from the cache, including stale values and keys cached as missing.", stats.Hits)
+	writeMetric(w, "redisproxy_cache_misses_total", "counter", "Lookups that went to Redis.", stats.Misses)
+	writeMetric(w, "redisproxy_cache_coalesced_total", "counter",
+		"Misses that shared another request's Redis fetch of the same key.", stats.Coalesced)
+	writeMetric(w, "redisproxy_cache_evictions_total", "counter", "Entries evicted to make room.", stats.Evictions)
+	writeMetric(w, "redisproxy_cache_expirations_total", "counter", "Entries removed once expired.", stats.Expirations)
+	writeMetric(w, "redisproxy_cache_entries", "gauge", "Values in the cache.", cache.GetSize())
+	writeMetric(w, "redisproxy_cache_bytes", "gauge",
+		"Approximate memory used by the entries in the cache.", cache.GetBytes())
+
+	pool := cache.pool.Stats()
+	writeMetric(w, "redisproxy_redis_pool_connections", "gauge", "Connections in the Redis pool, by state.", nil)
+	fmt.Fprintf(w, "redisproxy_redis_pool_connections{state=\"in_use\"} %d\n", pool.ActiveCount-pool.IdleCount)
+	fmt.Fprintf(w, "redisproxy_redis_pool_connections{state=\"idle\"} %d\n", pool.IdleCount)
+
+	histograms, counts := cache.metrics.snapshot()
+	commands := make([]string, 0, len(histograms))
+	for command := range histograms {
+		commands = append(commands, command)
+	}
+	sort.Strings(commands)
+
+	writeMetric(w, "redisproxy_redis_command_duration_seconds", "histogram", "Latency of Redis commands.", nil)
+	for _, command := range commands {
+		histogram := histograms[command]
+		var count int64
+		for i, bound := range latencyBuckets {
+			count += histogram.counts[i]
+			fmt.Fprintf(w, "redisproxy_redis_command_duration_seconds_bucket{command=%q,le=\"%g\"} %d\n",
+				command, bound, count)
+		}
+		count += histogram.counts[len(latencyBuckets)]
+		fmt.Fprintf(w, "redisproxy_redis_command_duration_seconds_bucket{command=%q,le=\"+Inf\"} %d\n", command, count)
+		fmt.Fprintf(w, "redisproxy_redis_command_duration_seconds_sum{command=%q} %g\n", command, histogram.sum)
+		fmt.Fprintf(w, "redisproxy_redis_command_duration_seconds_count{command=%q} %d\n", command, count)
+	}
+
+	writeMetric(w, "redisproxy_redis_command_errors_total", "counter", "Redis commands that failed.", nil)
+	for _, command := range commands {
+		fmt.Fprintf(w, "redisproxy_redis_command_errors_total{command=%q} %d\n",
+			command, histograms[command].errors)
+	}
+
+	responses := make([]responseLabels, 0, len(counts))
+	for labels := range counts {
+		responses = append(responses, labels)
+	}
+	sort.Slice(responses, func(i, j int) bool {
+		if responses[i].method != responses[j].method {
+			return responses[i].method < responses[j].method
+		}
+		return responses[i].code < responses[j].code
+	})
+
+	writeMetric(w, "redisproxy_http_requests_total", "counter", "HTTP requests served, by method and status code.", nil)
+	for _, labels := range responses {
+		fmt.Fprintf(w, "redisproxy_http_requests_total{method=%q,code=\"%d\"} %d\n",
+			labels.method, labels.code, counts[labels])
+	}
+}
+
+// Writes the HELP and TYPE lines of a metric, followed by its value unless value is nil, for metrics with labels.
+func writeMetric(w http.ResponseWriter, name, kind, help string, value interface{}) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	if value != nil {
+		fmt.Fprintf(w, "%s %d\n", name, value)
+	}
+}
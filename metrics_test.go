@@ -0,0 +1,127 @@
+package main
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Helper function that returns the metrics served on /metrics.
+func scrapeMetrics(t *testing.T, cache *cache) string {
+	res := routeRequest(cache, "GET", "/metrics", "")
+	if res.Code != http.StatusOK {
+		t.Fatalf("Expected /metrics to be served, got %d", res.Code)
+	}
+	return res.Body.String()
+}
+
+// Checks that hits, misses, evictions, expirations and the size of the cache are reported.
+func TestMetricsReportCacheActivity(t *testing.T) {
+	cache := NewCache(redisServer, 2, 60, maxConnections)
+	defer cache.Close()
+	redisDirect.Do("MSET", "metrics:1", "v", "metrics:2", "v", "metrics:3", "v")
+
+	for _, key := range []string{"metrics:1", "metrics:1", "metrics:2", "metrics:3"} {
+		cache.get(key)
+	}
+	cache.getMany([]string{"metrics:3", "metrics:4"})
+	expired := newNode("metrics:expired", "v", -time.Second, valuesSegment)
+	cache.shardFor("metrics:expired").put(expired)
+	cache.get("metrics:expired")
+
+	metrics := scrapeMetrics(t, cache)
+	for _, expected := range []string{
+		"redisproxy_cache_hits_total 2\n",
+		"redisproxy_cache_misses_total 5\n",
+		"redisproxy_cache_evictions_total 2\n",
+		"redisproxy_cache_expirations_total 1\n",
+		"redisproxy_cache_entries 1\n",
+		"# TYPE redisproxy_cache_bytes gauge\n",
+		"redisproxy_redis_pool_connections{state=\"in_use\"} 0\n",
+	} {
+		if !strings.Contains(metrics, expected) {
+			t.Errorf("Expected the metrics to contain %q, got:\n%s", expected, metrics)
+		}
+	}
+}
+
+// Checks that Redis commands are timed, whether sent with Do, with a timeout or pipelined, and their failures counted.
+func TestMetricsTimeRedisCommands(t *testing.T) {
+	cache := NewCache(redisServer, 2, 60, maxConnections)
+	defer cache.Close()
+	redisDirect.Do("SET", "metrics:timed", "v")
+
+	cache.get("metrics:timed")
+	conn := cache.pool.Get()
+	conn.Do("NOSUCHCOMMAND")
+	if _, err := redis.DoWithTimeout(conn, time.Second, "ECHO", "timed"); err != nil {
+		t.Errorf("Expected pool connections to support timeouts, got %v", err)
+	}
+	conn.Close()
+
+	metrics := scrapeMetrics(t, cache)
+	for _, expected := range []string{
+		// The PING sent by NewCache, and the GET and PTTL pipelined on a miss.
+		"redisproxy_redis_command_duration_seconds_count{command=\"PING\"} 1\n",
+		"redisproxy_redis_command_duration_seconds_count{command=\"GET\"} 1\n",
+		"redisproxy_redis_command_duration_seconds_bucket{command=\"PTTL\",le=\"+Inf\"} 1\n",
+		"redisproxy_redis_command_errors_total{command=\"GET\"} 0\n",
+		"redisproxy_redis_command_errors_total{command=\"NOSUCHCOMMAND\"} 1\n",
+		"redisproxy_redis_command_duration_seconds_count{command=\"ECHO\"} 1\n",
+		"redisproxy_redis_pool_connections{state=\"idle\"} 1\n",
+	} {
+		if !strings.Contains(metrics, expected) {
+			t.Errorf("Expected the metrics to contain %q, got:\n%s", expected, metrics)
+		}
+	}
+}
+
+// Checks that HTTP requests are counted by method and status code, including those matching no route, with unknown
+// methods counted together.
+func TestMetricsCountHTTPRequests(t *testing.T) {
+	cache := NewCache(redisServer, 2, 60, maxConnections)
+	defer cache.Close()
+	redisDirect.Do("SET", "metrics:http", "v")
+
+	routeRequest(cache, "GET", "/keys/metrics:http", "")
+	routeRequest(cache, "GET", "/keys/metrics:http", "")
+	routeRequest(cache, "GET", "/nothing/here", "")
+	routeRequest(cache, "PATCH", "/batch", "")
+	routeRequest(cache, "FOO1", "/batch", "")
+	routeRequest(cache, "FOO2", "/batch", "")
+
+	metrics := scrapeMetrics(t, cache)
+	for _, expected := range []string{
+		"redisproxy_http_requests_total{method=\"GET\",code=\"200\"} 2\n",
+		"redisproxy_http_requests_total{method=\"GET\",code=\"404\"} 1\n",
+		"redisproxy_http_requests_total{method=\"other\",code=\"405\"} 3\n",
+	} {
+		if !strings.Contains(metrics, expected) {
+			t.Errorf("Expected the metrics to contain %q, got:\n%s", expected, metrics)
+		}
+	}
+	if strings.Contains(metrics, "FOO") {
+		t.Errorf("Expected no series for unknown methods, got:\n%s", metrics)
+	}
+}
+
+// Checks that a snapshot of the metrics is a copy, unchanged by what is recorded while it is written out.
+func TestMetricsSnapshotIsCopy(t *testing.T) {
+	var metrics metrics
+	metrics.observeCommand("get", time.Millisecond, nil)
+	metrics.observeResponse("GET", http.StatusOK)
+
+	histograms, counts := metrics.snapshot()
+	metrics.observeCommand("get", time.Millisecond, nil)
+	metrics.observeResponse("GET", http.StatusOK)
+
+	var observed int64
+	for _, count := range histograms["GET"].counts {
+		observed += count
+	}
+	if observed != 1 || counts[responseLabels{"GET", http.StatusOK}] != 1 {
+		t.Errorf("Expected the snapshot to hold 1 command and 1 response, got %d and %v", observed, counts)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Checks that a value read often enough is refreshed from Redis before it expires, while still being served as a hit.
+func TestCacheRefreshesHotValuesAhead(t *testing.T) {
+	cache := NewCache(redisServer, 2, 60, maxConnections, WithRefreshAhead(0.5, 2))
+	defer cache.Close()
+	redisDirect.Do("SET", "hot", "new")
+	cache.putInCacheWithTTL("hot", "old", 200*time.Millisecond)
+
+	// Reads in the first half of the TTL don't trigger a refresh.
+	cache.get("hot")
+	if nodeRefreshing(cache, "hot") {
+		t.Errorf("Expected no refresh before the refresh-ahead window")
+	}
+
+	time.Sleep(120 * time.Millisecond)
+	if value, status, _ := cache.get("hot"); value != "old" || status != statusHit {
+		t.Errorf("Expected the cached value as a hit while refreshing, got %q %v", value, status)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for !cacheHolds(cache, "hot", "new") && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !cacheHolds(cache, "hot", "new") {
+		t.Errorf("Expected the value to be refreshed ahead of expiring")
+	}
+}
+
+// Checks that values read fewer times than required are left to expire.
+func TestCacheDoesNotRefreshColdValuesAhead(t *testing.T) {
+	cache := NewCache(redisServer, 2, 60, maxConnections, WithRefreshAhead(0.5, 3))
+	defer cache.Close()
+	cache.putInCacheWithTTL("cold", "old", 200*time.Millisecond)
+
+	time.Sleep(120 * time.Millisecond)
+	cache.get("cold")
+	if nodeRefreshing(cache, "cold") {
+		t.Errorf("Expected a value read once not to be refreshed")
+	}
+}
+
+// Checks that refresh-ahead is off unless configured.
+func TestCacheDoesNotRefreshAheadByDefault(t *testing.T) {
+	n := newNode(k1, v1, time.Millisecond, valuesSegment)
+	n.hits = 100
+	if n.dueForRefreshAhead(time.Now().Add(time.Second), 0) {
+		t.Errorf("Expected a node without refreshAt never to be due")
+	}
+}
@@ -0,0 +1,684 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/**
+This file implements a TCP front-end that speaks the Redis serialization protocol (RESP), so that redis-cli and
+existing Redis client libraries can use the proxy by only changing the address they connect to. Connections start out
+speaking RESP2, and clients may switch to RESP3 with the HELLO command.
+ */
+
+const (
+	// Same limits as a stock Redis server, to reject malformed requests before reading them.
+	maxBulkLength  = 512 * 1024 * 1024
+	maxArrayLength = 1024 * 1024
+	maxInlineSize  = 64 * 1024
+
+	// Lower limits for clients that have not authenticated yet, as on Redis 7, so that they can't make the proxy hold
+	// more than a few bulk strings of 16 KiB.
+	maxUnauthenticatedBulkLength  = 16 * 1024
+	maxUnauthenticatedArrayLength = 10
+
+	// Memory set aside for a bulk string or command array before its data arrives. Longer ones grow as it does, so
+	// declaring a huge length without sending the data doesn't make the proxy allocate it.
+	bulkChunkSize   = 64 * 1024
+	maxPreallocated = 1024
+)
+
+// Protocol versions a client can negotiate with HELLO.
+const (
+	resp2 = 2
+	resp3 = 3
+)
+
+// Reported by HELLO as the server version.
+const serverVersion = "1.0.0"
+
+// The only user known to the proxy, as on a Redis server without ACLs configured.
+const defaultUser = "default"
+
+// Returned for malformed client input. The connection is closed after reporting it, since there is no reliable way
+// to find the start of the next command.
+type protocolError string
+
+func (e protocolError) Error() string {
+	return "Protocol error: " + string(e)
+}
+
+// Reads commands sent by a client, either as RESP arrays of bulk strings or as inline commands typed into a telnet
+// session.
+type respReader struct {
+	reader *bufio.Reader
+}
+
+func newRESPReader(r io.Reader) *respReader {
+	// Buffer whole inline commands, as lines are read with ReadSlice.
+	return &respReader{reader: bufio.NewReaderSize(r, maxInlineSize)}
+}
+
+// Reads a single line terminated by CRLF and returns it without the terminator.
+func (r *respReader) readLine() (string, error) {
+	line, err := r.reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", protocolError("too big inline request")
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", protocolError("expected CRLF line terminator")
+	}
+
+	return string(line[:len(line)-2]), nil
+}
+
+// Parses the length that follows a '*' or '$' prefix. Negative lengths are rejected: clients never send null arrays
+// or bulk strings.
+func parseLength(line string, limit int) (int, error) {
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 || n > limit {
+		return 0, protocolError(fmt.Sprintf("invalid length %q", line[1:]))
+	}
+
+	return n, nil
+}
+
+// Returns the next command as a list of arguments, the first of which is the command name. Returns a nil slice for
+// empty inline commands, which clients send as keep-alives and should be ignored. Commands of clients that have not
+// authenticated are held to lower limits.
+func (r *respReader) readCommand(authenticated bool) ([]string, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) == 0 || line[0] != '*' {
+		if len(line) > maxInlineSize {
+			return nil, protocolError("too big inline request")
+		}
+		return strings.Fields(line), nil
+	}
+
+	arrayLimit, bulkLimit := maxArrayLength, maxBulkLength
+	if !authenticated {
+		arrayLimit, bulkLimit = maxUnauthenticatedArrayLength, maxUnauthenticatedBulkLength
+	}
+
+	count, err := parseLength(line, arrayLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, 0, minInt(count, maxPreallocated))
+	for i := 0; i < count; i++ {
+		arg, err := r.readBulkString(bulkLimit)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+
+	return args, nil
+}
+
+// Reads one "$<length>\r\n<data>\r\n" element of a command array, of at most limit bytes. The data itself is read by
+// length, so arguments may contain arbitrary bytes including CR and LF.
+func (r *respReader) readBulkString(limit int) (string, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return "", err
+	}
+
+	if len(line) == 0 || line[0] != '$' {
+		return "", protocolError(fmt.Sprintf("expected '$', got %q", line))
+	}
+
+	length, err := parseLength(line, limit)
+	if err != nil {
+		return "", protocolError("invalid bulk length")
+	}
+
+	var data bytes.Buffer
+	data.Grow(minInt(length+2, bulkChunkSize))
+	if _, err := io.CopyN(&data, r.reader, int64(length+2)); err != nil {
+		return "", err
+	}
+
+	buf := data.Bytes()
+	if buf[length] != '\r' || buf[length+1] != '\n' {
+		return "", protocolError("expected CRLF after bulk string")
+	}
+
+	return string(buf[:length]), nil
+}
+
+// Serializes replies to a client. Replies are buffered and only sent when flush() is called, which lets pipelined
+// commands be answered with a single write. RESP3 types are downgraded to their RESP2 equivalents unless the client
+// negotiated protocol 3.
+type respWriter struct {
+	writer   *bufio.Writer
+	protocol int
+}
+
+func newRESPWriter(w io.Writer) *respWriter {
+	return &respWriter{writer: bufio.NewWriter(w), protocol: resp2}
+}
+
+func (w *respWriter) writeSimpleString(s string) {
+	w.writer.WriteString("+" + s + "\r\n")
+}
+
+// Writes an error reply. Following Redis convention, the first word of the message is the error code.
+func (w *respWriter) writeError(message string) {
+	w.writer.WriteString("-" + strings.NewReplacer("\r", " ", "\n", " ").Replace(message) + "\r\n")
+}
+
+func (w *respWriter) writeInteger(n int64) {
+	w.writer.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func (w *respWriter) writeBulkString(s string) {
+	w.writer.WriteString("$" + strconv.Itoa(len(s)) + "\r\n")
+	w.writer.WriteString(s)
+	w.writer.WriteString("\r\n")
+}
+
+// Writes the null reply, which is a nil bulk string in RESP2.
+func (w *respWriter) writeNil() {
+	if w.protocol == resp3 {
+		w.writer.WriteString("_\r\n")
+		return
+	}
+	w.writer.WriteString("$-1\r\n")
+}
+
+func (w *respWriter) writeArrayHeader(n int) {
+	w.writer.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+// Starts a map of n key/value pairs, which must be followed by 2n elements. RESP2 clients receive a flat array.
+func (w *respWriter) writeMapHeader(n int) {
+	if w.protocol == resp3 {
+		w.writer.WriteString("%" + strconv.Itoa(n) + "\r\n")
+		return
+	}
+	w.writeArrayHeader(2 * n)
+}
+
+func (w *respWriter) flush() error {
+	return w.writer.Flush()
+}
+
+// A command handler. Arity follows the Redis convention: a positive number is the exact number of arguments including
+// the command name, a negative number is the minimum. Commands marked noAuth may run before the client authenticates.
+type respCommand struct {
+	arity   int
+	handler func(conn *respConn, args []string)
+	noAuth  bool
+}
+
+var respCommands map[string]respCommand
+
+func init() {
+	respCommands = map[string]respCommand{
+		"GET":     {2, (*respConn).get, false},
+		"MGET":    {-2, (*respConn).mget, false},
+		"SET":     {-3, (*respConn).set, false},
+		"DEL":     {-2, (*respConn).del, false},
+		"PING":    {-1, (*respConn).ping, false},
+		"ECHO":    {2, (*respConn).echo, false},
+		"QUIT":    {1, (*respConn).quit, true},
+		"COMMAND": {-1, (*respConn).command, false},
+		"HELLO":   {-1, (*respConn).hello, true},
+		"AUTH":    {-2, (*respConn).auth, true},
+		"CLIENT":  {-2, (*respConn).client, false},
+	}
+}
+
+// Accepts client connections and serves each of them on its own goroutine. If password is not empty, clients must
+// authenticate with AUTH or HELLO before running other commands.
+type respServer struct {
+	cache    *cache
+	password string
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+	lastID   int64
+}
+
+func NewRESPServer(cache *cache, password string) *respServer {
+	s := new(respServer)
+	s.cache = cache
+	s.password = password
+	s.conns = make(map[net.Conn]struct{})
+	return s
+}
+
+// Listens on the TCP address and serves clients until Close() is called.
+func (server *respServer) ListenAndServe(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	return server.Serve(listener)
+}
+
+func (server *respServer) Serve(listener net.Listener) error {
+	server.mu.Lock()
+	if server.closed {
+		server.mu.Unlock()
+		listener.Close()
+		return errors.New("resp server closed")
+	}
+	server.listener = listener
+	server.mu.Unlock()
+
+	for {
+		netConn, err := listener.Accept()
+		if err != nil {
+			server.mu.Lock()
+			closed := server.closed
+			server.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+
+		go server.serveConn(netConn)
+	}
+}
+
+// Stops accepting new clients and disconnects the existing ones.
+func (server *respServer) Close() error {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	server.closed = true
+	for netConn := range server.conns {
+		netConn.Close()
+	}
+
+	if server.listener != nil {
+		return server.listener.Close()
+	}
+	return nil
+}
+
+func (server *respServer) serveConn(netConn net.Conn) {
+	server.mu.Lock()
+	if server.closed {
+		server.mu.Unlock()
+		netConn.Close()
+		return
+	}
+	server.conns[netConn] = struct{}{}
+	server.mu.Unlock()
+
+	defer func() {
+		server.mu.Lock()
+		delete(server.conns, netConn)
+		server.mu.Unlock()
+		netConn.Close()
+	}()
+
+	conn := &respConn{
+		server:        server,
+		reader:        newRESPReader(netConn),
+		writer:        newRESPWriter(netConn),
+		id:            atomic.AddInt64(&server.lastID, 1),
+		authenticated: server.password == "",
+	}
+	conn.serve()
+}
+
+// State of a single client connection. The negotiated protocol version lives in the writer.
+type respConn struct {
+	server        *respServer
+	reader        *respReader
+	writer        *respWriter
+	id            int64
+	name          string
+	authenticated bool
+	closing       bool
+}
+
+// Reads and executes commands until the client disconnects or sends QUIT. Replies are flushed once there is no more
+// pipelined input waiting to be processed.
+func (conn *respConn) serve() {
+	for !conn.closing {
+		args, err := conn.reader.readCommand(conn.authenticated)
+		if err != nil {
+			if protoErr, ok := err.(protocolError); ok {
+				conn.writer.writeError("ERR " + protoErr.Error())
+				conn.writer.flush()
+			}
+			return
+		}
+
+		if len(args) > 0 {
+			conn.dispatch(args)
+		}
+
+		if conn.reader.reader.Buffered() == 0 {
+			if err := conn.writer.flush(); err != nil {
+				return
+			}
+		}
+	}
+
+	conn.writer.flush()
+}
+
+// Looks up the command by name, checks its arity and runs it.
+func (conn *respConn) dispatch(args []string) {
+	name := strings.ToUpper(args[0])
+	command, ok := respCommands[name]
+	if !ok {
+		conn.writer.writeError(fmt.Sprintf("ERR unknown command '%s', with args beginning with: %s", args[0],
+			formatArgs(args[1:])))
+		return
+	}
+
+	if (command.arity > 0 && len(args) != command.arity) || (command.arity < 0 && len(args) < -command.arity) {
+		conn.writer.writeError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+		return
+	}
+
+	if !conn.authenticated && !command.noAuth {
+		conn.writer.writeError("NOAUTH Authentication required.")
+		return
+	}
+
+	command.handler(conn, args)
+}
+
+func formatArgs(args []string) string {
+	var b strings.Builder
+	for _, arg := range args {
+		b.WriteString(fmt.Sprintf("'%s' ", arg))
+	}
+	return b.String()
+}
+
+// Serves GET through the cache. Keys missing from Redis get a nil reply, and Redis failures an error.
+func (conn *respConn) get(args []string) {
+	value, status, err := conn.server.cache.get(args[1])
+	switch status {
+	case statusNotFound:
+		conn.writer.writeNil()
+	case statusError:
+		conn.writer.writeError(backendErrorMessage(err))
+	default:
+		conn.writer.writeBulkString(value)
+	}
+}
+
+func (conn *respConn) mget(args []string) {
+	values, err := conn.server.cache.getMany(args[1:])
+	if err != nil {
+		conn.writer.writeError(backendErrorMessage(err))
+		return
+	}
+
+	conn.writer.writeArrayHeader(len(args) - 1)
+	for _, key := range args[1:] {
+		if value := values[key]; value != nil {
+			conn.writer.writeBulkString(*value)
+		} else {
+			conn.writer.writeNil()
+		}
+	}
+}
+
+func (conn *respConn) set(args []string) {
+	options, err := parseSetArgs(args[3:])
+	if err != nil {
+		conn.writer.writeError(err.Error())
+		return
+	}
+
+	set, err := conn.server.cache.set(args[1], args[2], options)
+	switch {
+	case err != nil:
+		conn.writer.writeError(backendErrorMessage(err))
+	case !set:
+		conn.writer.writeNil()
+	default:
+		conn.writer.writeSimpleString("OK")
+	}
+}
+
+// Parses the options of a SET command: EX seconds, PX milliseconds, NX and XX.
+func parseSetArgs(args []string) (setOptions, error) {
+	var options setOptions
+	for i := 0; i < len(args); i++ {
+		switch option := strings.ToUpper(args[i]); {
+		case option == "NX" && !options.xx:
+			options.nx = true
+		case option == "XX" && !options.nx:
+			options.xx = true
+		case (option == "EX" || option == "PX") && options.ttl == 0 && i+1 < len(args):
+			unit := time.Second
+			if option == "PX" {
+				unit = time.Millisecond
+			}
+
+			i++
+			ttl, err := parseExpiry(args[i], unit)
+			if err != nil {
+				return options, errors.New("ERR invalid expire time in 'set' command")
+			}
+			options.ttl = ttl
+		default:
+			return options, errors.New("ERR syntax error")
+		}
+	}
+	return options, nil
+}
+
+func (conn *respConn) del(args []string) {
+	deleted, err := conn.server.cache.del(args[1:])
+	if err != nil {
+		conn.writer.writeError(backendErrorMessage(err))
+		return
+	}
+	conn.writer.writeInteger(int64(deleted))
+}
+
+// Error replies from Redis are passed through as they are, so clients see the usual WRONGTYPE and such. Other failures
+// mean Redis could not be reached.
+func backendErrorMessage(err error) string {
+	if _, ok := err.(redis.Error); ok {
+		return err.Error()
+	}
+	return "ERR backend unavailable: " + err.Error()
+}
+
+func (conn *respConn) ping(args []string) {
+	switch len(args) {
+	case 1:
+		conn.writer.writeSimpleString("PONG")
+	case 2:
+		conn.writer.writeBulkString(args[1])
+	default:
+		conn.writer.writeError("ERR wrong number of arguments for 'ping' command")
+	}
+}
+
+func (conn *respConn) echo(args []string) {
+	conn.writer.writeBulkString(args[1])
+}
+
+func (conn *respConn) quit(args []string) {
+	conn.writer.writeSimpleString("OK")
+	conn.closing = true
+}
+
+// redis-cli and some client libraries issue COMMAND (or COMMAND DOCS) on connect to discover the server's commands.
+// An empty reply tells them to fall back to their built-in defaults.
+func (conn *respConn) command(args []string) {
+	conn.writer.writeArrayHeader(0)
+}
+
+// Checks a username and password against the server's password. As on a Redis server without ACLs, "default" is the
+// only user, and any password is accepted when none is configured.
+func (conn *respConn) checkCredentials(username, password string) bool {
+	if username != defaultUser {
+		return false
+	}
+	return conn.server.password == "" ||
+		subtle.ConstantTimeCompare([]byte(password), []byte(conn.server.password)) == 1
+}
+
+// AUTH [username] password
+func (conn *respConn) auth(args []string) {
+	if len(args) > 3 {
+		conn.writer.writeError("ERR syntax error")
+		return
+	}
+
+	username, password := defaultUser, args[len(args)-1]
+	if len(args) == 3 {
+		username = args[1]
+	} else if conn.server.password == "" {
+		conn.writer.writeError("ERR AUTH <password> called without any password configured for the default user. " +
+			"Are you sure your configuration is correct?")
+		return
+	}
+
+	if !conn.checkCredentials(username, password) {
+		conn.writer.writeError("WRONGPASS invalid username-password pair or user is disabled.")
+		return
+	}
+
+	conn.authenticated = true
+	conn.writer.writeSimpleString("OK")
+}
+
+// HELLO [protover [AUTH username password] [SETNAME clientname]]
+//
+// Switches the connection to the requested protocol version, optionally authenticating and naming it in the same
+// round trip, and replies with a map describing the server. Nothing changes unless every option is valid.
+func (conn *respConn) hello(args []string) {
+	protocol := conn.writer.protocol
+	if len(args) > 1 {
+		version, err := strconv.Atoi(args[1])
+		if err != nil {
+			conn.writer.writeError("ERR Protocol version is not an integer or out of range")
+			return
+		}
+
+		if version != resp2 && version != resp3 {
+			conn.writer.writeError("NOPROTO unsupported protocol version")
+			return
+		}
+		protocol = version
+	}
+
+	authenticated, name, setName := conn.authenticated, "", false
+	for i := 2; i < len(args); i++ {
+		option := strings.ToUpper(args[i])
+		switch {
+		case option == "AUTH" && i+2 < len(args):
+			if !conn.checkCredentials(args[i+1], args[i+2]) {
+				conn.writer.writeError("WRONGPASS invalid username-password pair or user is disabled.")
+				return
+			}
+			authenticated = true
+			i += 2
+		case option == "SETNAME" && i+1 < len(args):
+			if !validClientName(args[i+1]) {
+				conn.writer.writeError("ERR Client names cannot contain spaces, newlines or special characters.")
+				return
+			}
+			name, setName = args[i+1], true
+			i++
+		default:
+			conn.writer.writeError(fmt.Sprintf("ERR Syntax error in HELLO option '%s'", args[i]))
+			return
+		}
+	}
+
+	if !authenticated {
+		conn.writer.writeError("NOAUTH HELLO must be called with the client already authenticated, otherwise the " +
+			"HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP " +
+			"protocol version at the same time")
+		return
+	}
+
+	conn.authenticated = true
+	conn.writer.protocol = protocol
+	if setName {
+		conn.name = name
+	}
+
+	conn.writer.writeMapHeader(7)
+	conn.writer.writeBulkString("server")
+	conn.writer.writeBulkString("redisproxy")
+	conn.writer.writeBulkString("version")
+	conn.writer.writeBulkString(serverVersion)
+	conn.writer.writeBulkString("proto")
+	conn.writer.writeInteger(int64(protocol))
+	conn.writer.writeBulkString("id")
+	conn.writer.writeInteger(conn.id)
+	conn.writer.writeBulkString("mode")
+	conn.writer.writeBulkString("standalone")
+	conn.writer.writeBulkString("role")
+	conn.writer.writeBulkString("master")
+	conn.writer.writeBulkString("modules")
+	conn.writer.writeArrayHeader(0)
+}
+
+// CLIENT ID | GETNAME | SETNAME clientname
+func (conn *respConn) client(args []string) {
+	subcommand := strings.ToUpper(args[1])
+	switch {
+	case subcommand == "ID" && len(args) == 2:
+		conn.writer.writeInteger(conn.id)
+	case subcommand == "GETNAME" && len(args) == 2:
+		if conn.name == "" {
+			conn.writer.writeNil()
+			return
+		}
+		conn.writer.writeBulkString(conn.name)
+	case subcommand == "SETNAME" && len(args) == 3:
+		if !validClientName(args[2]) {
+			conn.writer.writeError("ERR Client names cannot contain spaces, newlines or special characters.")
+			return
+		}
+		conn.name = args[2]
+		conn.writer.writeSimpleString("OK")
+	default:
+		conn.writer.writeError(fmt.Sprintf("ERR unknown subcommand or wrong number of arguments for '%s'", args[1]))
+	}
+}
+
+// Client names are shown in space separated lists, so like Redis only printable characters other than space are
+// allowed.
+func validClientName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if name[i] < '!' || name[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
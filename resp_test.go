@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"io"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+/**
+Tests for the RESP front-end. Parsing and serialization are tested in isolation, the rest against a RESP server started
+in-process on a random port, backed by the Redis store booted in docker-compose.
+ */
+
+var respPort = 6380
+
+// Starts a RESP server for the cache on a random local port, and returns a client connection to it.
+func startRESPServer(t *testing.T, cache *cache) (*respServer, redis.Conn) {
+	server, address := listenRESP(t, cache, "")
+	client, err := redis.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return server, client
+}
+
+// Starts a RESP server for the cache on a random local port, and returns the address it listens on.
+func listenRESP(t *testing.T, cache *cache, password string) (*respServer, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := NewRESPServer(cache, password)
+	go server.Serve(listener)
+	return server, listener.Addr().String()
+}
+
+// Redigo only speaks RESP2, so RESP3 replies are checked on the wire. Sends a command over conn and returns the raw
+// text of the complete reply.
+func rawCommand(t *testing.T, conn net.Conn, reader *bufio.Reader, args ...string) string {
+	var b bytes.Buffer
+	b.WriteString(fmt.Sprintf("*%d\r\n", len(args)))
+	for _, arg := range args {
+		b.WriteString(fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg))
+	}
+
+	if _, err := conn.Write(b.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	reply, err := readRawReply(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+// Reads one reply of any type, including the elements of aggregate replies.
+func readRawReply(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+
+	switch line[0] {
+	case '$':
+		n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if n < 0 {
+			return line, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return "", err
+		}
+		return line + string(data), nil
+	case '*', '%', '>':
+		n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if line[0] == '%' {
+			n *= 2
+		}
+		for i := 0; i < n; i++ {
+			element, err := readRawReply(reader)
+			if err != nil {
+				return "", err
+			}
+			line += element
+		}
+	}
+	return line, nil
+}
+
+// Checks that commands are parsed from both RESP arrays and inline commands, and that bulk strings are binary safe.
+func TestRESPReaderParsesCommands(t *testing.T) {
+	long := strings.Repeat("x", 8*1024)
+	input := "*2\r\n$3\r\nGET\r\n$4\r\na\r\nb\r\n" + "PING hello\r\n" + "\r\n" + "ECHO " + long + "\r\n"
+	reader := newRESPReader(bytes.NewBufferString(input))
+
+	args, err := reader.readCommand(true)
+	if err != nil || len(args) != 2 || args[0] != "GET" || args[1] != "a\r\nb" {
+		t.Errorf("Expected [GET a\\r\\nb], got %q (%v)", args, err)
+	}
+
+	args, err = reader.readCommand(true)
+	if err != nil || len(args) != 2 || args[0] != "PING" || args[1] != "hello" {
+		t.Errorf("Expected inline command [PING hello], got %q (%v)", args, err)
+	}
+
+	args, err = reader.readCommand(true)
+	if err != nil || len(args) != 0 {
+		t.Errorf("Expected empty inline command to be skipped, got %q (%v)", args, err)
+	}
+
+	args, err = reader.readCommand(true)
+	if err != nil || len(args) != 2 || args[1] != long {
+		t.Errorf("Expected inline commands longer than a read buffer to be parsed, got %d args (%v)", len(args), err)
+	}
+}
+
+// Checks that malformed input is reported as a protocol error.
+func TestRESPReaderRejectsMalformedInput(t *testing.T) {
+	tooLong := strings.Repeat("x", maxInlineSize) + "\r\n"
+	for _, input := range []string{"*1\r\n:5\r\n", "*1\r\n$x\r\n", "*1\r\n$3\r\nGETxx", "*1\n", "*-5\r\n", "*-1\r\n",
+		"*1\r\n$-1\r\n", tooLong} {
+		_, err := newRESPReader(bytes.NewBufferString(input)).readCommand(true)
+		if _, ok := err.(protocolError); !ok {
+			t.Errorf("For input %q, expected a protocol error but got %v", input, err)
+		}
+	}
+}
+
+// Checks that clients that have not authenticated are held to lower limits, as on Redis 7.
+func TestRESPReaderLimitsUnauthenticatedClients(t *testing.T) {
+	bulk := strings.Repeat("x", maxUnauthenticatedBulkLength)
+	for _, input := range []string{"*11\r\n", "*1\r\n$16385\r\n"} {
+		_, err := newRESPReader(bytes.NewBufferString(input)).readCommand(false)
+		if _, ok := err.(protocolError); !ok {
+			t.Errorf("For input %q, expected a protocol error but got %v", input, err)
+		}
+		if _, err := newRESPReader(bytes.NewBufferString(input)).readCommand(true); err != io.EOF {
+			t.Errorf("For input %q, expected authenticated clients to read on until the input ends, got %v", input, err)
+		}
+	}
+
+	input := "*2\r\n$4\r\nAUTH\r\n$16384\r\n" + bulk + "\r\n"
+	if args, err := newRESPReader(bytes.NewBufferString(input)).readCommand(false); err != nil || len(args) != 2 {
+		t.Errorf("Expected bulk strings of up to 16 KiB to be read, got %d args (%v)", len(args), err)
+	}
+}
+
+// Checks that a huge declared bulk string is not allocated before its data arrives, since it may never do.
+func TestRESPReaderDoesNotAllocateDeclaredLengths(t *testing.T) {
+	reader := newRESPReader(bytes.NewBufferString("*1\r\n$536870000\r\n"))
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := reader.readCommand(true)
+	runtime.ReadMemStats(&after)
+
+	if err == nil {
+		t.Errorf("Expected the missing data to fail the read")
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1024*1024 {
+		t.Errorf("Expected a small buffer until the data arrives, got %d bytes allocated", allocated)
+	}
+}
+
+// Checks the wire format of each reply type.
+func TestRESPWriterSerializesReplies(t *testing.T) {
+	var buf bytes.Buffer
+	writer := newRESPWriter(&buf)
+	writer.writeSimpleString("OK")
+	writer.writeError("ERR bad\r\nthing")
+	writer.writeInteger(-7)
+	writer.writeBulkString("v1")
+	writer.writeNil()
+	writer.writeArrayHeader(0)
+	writer.flush()
+
+	expected := "+OK\r\n-ERR bad  thing\r\n:-7\r\n$2\r\nv1\r\n$-1\r\n*0\r\n"
+	if buf.String() != expected {
+		t.Errorf("Expected %q but got %q", expected, buf.String())
+	}
+}
+
+// Checks that RESP3 types are used once protocol 3 is negotiated, and downgraded for RESP2 clients.
+func TestRESPWriterSerializesRESP3Types(t *testing.T) {
+	var buf bytes.Buffer
+	writer := newRESPWriter(&buf)
+	for _, protocol := range []int{resp2, resp3} {
+		writer.protocol = protocol
+		writer.writeNil()
+		writer.writeMapHeader(1)
+	}
+	writer.flush()
+
+	expected := "$-1\r\n*2\r\n" + "_\r\n%1\r\n"
+	if buf.String() != expected {
+		t.Errorf("Expected %q but got %q", expected, buf.String())
+	}
+}
+
+// Checks that HELLO switches a connection between RESP2 and RESP3, and that replies follow the negotiated protocol.
+func TestRESPServerNegotiatesProtocolWithHello(t *testing.T) {
+	cache := NewCache(redisServer, 2, 60, maxConnections)
+	defer cache.Close()
+	server, address := listenRESP(t, cache, "")
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	redisDirect.Do("DEL", "resp:missing")
+	if reply := rawCommand(t, conn, reader, "GET", "resp:missing"); reply != "$-1\r\n" {
+		t.Errorf("Expected a RESP2 nil before HELLO, got %q", reply)
+	}
+
+	reply := rawCommand(t, conn, reader, "HELLO", "3", "SETNAME", "worker-1")
+	if !strings.HasPrefix(reply, "%7\r\n$6\r\nserver\r\n") || !strings.Contains(reply, "$5\r\nproto\r\n:3\r\n") {
+		t.Errorf("Expected a RESP3 map announcing proto 3, got %q", reply)
+	}
+
+	if reply := rawCommand(t, conn, reader, "GET", "resp:missing"); reply != "_\r\n" {
+		t.Errorf("Expected a RESP3 null after HELLO 3, got %q", reply)
+	}
+
+	if reply := rawCommand(t, conn, reader, "CLIENT", "GETNAME"); reply != "$8\r\nworker-1\r\n" {
+		t.Errorf("Expected the name set by HELLO, got %q", reply)
+	}
+
+	if reply := rawCommand(t, conn, reader, "HELLO", "4"); !strings.HasPrefix(reply, "-NOPROTO") {
+		t.Errorf("Expected NOPROTO for an unsupported version, got %q", reply)
+	}
+
+	reply = rawCommand(t, conn, reader, "HELLO", "2")
+	if !strings.HasPrefix(reply, "*14\r\n") || !strings.Contains(reply, "$5\r\nproto\r\n:2\r\n") {
+		t.Errorf("Expected a flattened map announcing proto 2, got %q", reply)
+	}
+
+	if reply := rawCommand(t, conn, reader, "GET", "resp:missing"); reply != "$-1\r\n" {
+		t.Errorf("Expected a RESP2 nil after HELLO 2, got %q", reply)
+	}
+}
+
+// Checks that a password protected server only accepts commands after AUTH or HELLO with AUTH.
+func TestRESPServerRequiresAuthentication(t *testing.T) {
+	cache := NewCache(redisServer, 2, 60, maxConnections)
+	defer cache.Close()
+	server, address := listenRESP(t, cache, "secret")
+	defer server.Close()
+	client, err := redis.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if _, err := client.Do("GET", k1); err == nil || !strings.HasPrefix(err.Error(), "NOAUTH") {
+		t.Errorf("Expected NOAUTH before authenticating, got %v", err)
+	}
+
+	if _, err := client.Do("HELLO", "3", "AUTH", "default", "wrong"); err == nil || !strings.HasPrefix(err.Error(), "WRONGPASS") {
+		t.Errorf("Expected WRONGPASS for a bad password, got %v", err)
+	}
+
+	if _, err := client.Do("HELLO", "2", "AUTH", "default", "secret"); err != nil {
+		t.Errorf("Expected HELLO with AUTH to succeed, got %v", err)
+	}
+
+	if _, err := client.Do("GET", k1); err != nil {
+		t.Errorf("Expected GET to succeed once authenticated, got %v", err)
+	}
+
+	other, err := redis.Dial("tcp", address, redis.DialPassword("secret"))
+	if err != nil {
+		t.Fatalf("Expected AUTH on connect to succeed, got %v", err)
+	}
+	other.Close()
+}
+
+// Checks that a Redis client library can GET values through the proxy, including keys missing from Redis.
+func TestRESPServerServesGetThroughCache(t *testing.T) {
+	cache := NewCache(redisServer, 2, 60, maxConnections)
+	defer cache.Close()
+	server, client := startRESPServer(t, cache)
+	defer server.Close()
+	defer client.Close()
+
+	redisDirect.Do("SET", "resp:k1", "resp:v1")
+	redisDirect.Do("DEL", "resp:missing")
+
+	value, err := redis.String(client.Do("GET", "resp:k1"))
+	if err != nil || value != "resp:v1" {
+		t.Errorf("Expected resp:v1 but got %q (%v)", value, err)
+	}
+
+	if _, status, _ := cache.get("resp:k1"); status != statusHit {
+		t.Errorf("Value fetched over RESP should have been stored in the cache")
+	}
+
+	reply, err := client.Do("GET", "resp:missing")
+	if reply != nil || err != nil {
+		t.Errorf("Expected a nil reply for a missing key but got %v (%v)", reply, err)
+	}
+
+	redisDirect.Do("SET", "resp:empty", "")
+	reply, err = client.Do("GET", "resp:empty")
+	if value, ok := reply.([]byte); !ok || len(value) != 0 || err != nil {
+		t.Errorf("Expected an empty bulk string for an empty value but got %v (%v)", reply, err)
+	}
+
+	redisDirect.Do("DEL", "resp:list")
+	redisDirect.Do("RPUSH", "resp:list", "x")
+	if _, err := client.Do("GET", "resp:list"); err == nil || !strings.HasPrefix(err.Error(), "WRONGTYPE") {
+		t.Errorf("Expected the WRONGTYPE error from Redis but got %v", err)
+	}
+}
+
+// Checks that MGET replies with an array of values, with nil for missing keys.
+func TestRESPServerServesMGetThroughCache(t *testing.T) {
+	cache := NewCache(redisServer, 2, 60, maxConnections)
+	defer cache.Close()
+	server, client := startRESPServer(t, cache)
+	defer server.Close()
+	defer client.Close()
+
+	redisDirect.Do("SET", "resp:k1", "resp:v1")
+	redisDirect.Do("DEL", "resp:missing")
+
+	values, err := redis.Values(client.Do("MGET", "resp:k1", "resp:missing", "resp:k1"))
+	if err != nil || len(values) != 3 || string(values[0].([]byte)) != "resp:v1" || values[1] != nil ||
+		string(values[2].([]byte)) != "resp:v1" {
+		t.Errorf("Expected [resp:v1 nil resp:v1] but got %v (%v)", values, err)
+	}
+}
+
+// Checks that SET and DEL write through to Redis and update the cache, with SET options and their errors.
+func TestRESPServerWritesThroughSetAndDel(t *testing.T) {
+	cache := NewCache(redisServer, 2, 60, maxConnections)
+	defer cache.Close()
+	server, client := startRESPServer(t, cache)
+	defer server.Close()
+	defer client.Close()
+	redisDirect.Do("DEL", "resp:w1", "resp:w2")
+
+	if reply, err := redis.String(client.Do("SET", "resp:w1", "v1", "px", "100000", "NX")); reply != "OK" || err != nil {
+		t.Errorf("Expected OK but got %q (%v)", reply, err)
+	}
+	if !cacheHolds(cache, "resp:w1", "v1") {
+		t.Errorf("Expected the written value to be cached")
+	}
+	if pttl, _ := redis.Int(redisDirect.Do("PTTL", "resp:w1")); pttl <= 0 || pttl > 100000 {
+		t.Errorf("Expected the key to expire in Redis, PTTL %d", pttl)
+	}
+
+	if reply, err := client.Do("SET", "resp:w1", "v2", "NX"); reply != nil || err != nil {
+		t.Errorf("Expected a nil reply when NX fails, got %v (%v)", reply, err)
+	}
+
+	invalid := map[string][]interface{}{
+		"ERR syntax error":                         {"resp:w1", "v", "NX", "XX"},
+		"ERR invalid expire time in 'set' command": {"resp:w1", "v", "EX", "-1"},
+	}
+	for expected, args := range invalid {
+		if _, err := client.Do("SET", args...); err == nil || err.Error() != expected {
+			t.Errorf("For SET %v, expected %s but got %v", args, expected, err)
+		}
+	}
+
+	if deleted, err := redis.Int(client.Do("DEL", "resp:w1", "resp:w2")); deleted != 1 || err != nil {
+		t.Errorf("Expected 1 key deleted but got %d (%v)", deleted, err)
+	}
+	if _, status := cache.fetchFromCache("resp:w1"); status != statusMiss {
+		t.Errorf("Expected the deleted key to be gone from the cache, got %v", status)
+	}
+}
+
+// Checks error replies for unknown commands and wrong arity, and that the connection stays usable afterwards.
+func TestRESPServerRepliesWithErrors(t *testing.T) {
+	cache := NewCache(redisServer, 2, 60, maxConnections)
+	defer cache.Close()
+	server, client := startRESPServer(t, cache)
+	defer server.Close()
+	defer client.Close()
+
+	if _, err := client.Do("NOSUCHCOMMAND", "x"); err == nil {
+		t.Errorf("Expected an error for an unknown command")
+	}
+
+	if _, err := client.Do("GET"); err == nil {
+		t.Errorf("Expected an error for GET without a key")
+	}
+
+	pong, err := redis.String(client.Do("PING"))
+	if err != nil || pong != "PONG" {
+		t.Errorf("Expected PONG but got %q (%v)", pong, err)
+	}
+}
+
+// Checks that pipelined commands are all answered, in order.
+func TestRESPServerAnswersPipelinedCommands(t *testing.T) {
+	cache := NewCache(redisServer, 10, 60, maxConnections)
+	defer cache.Close()
+	server, client := startRESPServer(t, cache)
+	defer server.Close()
+	defer client.Close()
+
+	setKeyValPairsInRange(1, 5)
+	for i := 1; i <= 5; i++ {
+		client.Send("GET", fmt.Sprintf("k%d", i))
+	}
+	client.Flush()
+
+	for i := 1; i <= 5; i++ {
+		value, err := redis.String(client.Receive())
+		if expected := fmt.Sprintf("v%d", i); err != nil || value != expected {
+			t.Errorf("Expected %s but got %q (%v)", expected, value, err)
+		}
+	}
+}
+
+// Checks that the RESP front-end of the proxy booted in docker-compose is up.
+func TestCacheAcceptsRESPConnections(t *testing.T) {
+	client, err := redis.Dial("tcp", fmt.Sprintf("localhost:%d", respPort))
+	if err != nil {
+		t.Fatalf("Failed to connect to RESP front-end: %v", err)
+	}
+	defer client.Close()
+
+	value, err := redis.String(client.Do("GET", k1))
+	if err != nil || value != v1 {
+		t.Errorf("For key %s, expected %s but got %q (%v)", k1, v1, value, err)
+	}
+}
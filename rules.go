@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+Per-namespace cache policies. Several tenants can share one Redis while getting different caching behavior, by
+matching their keys against a table of rules. Rules are configured as a semicolon separated list, in order of
+precedence, each a glob pattern followed by "=" and comma separated settings:
+
+  session:*=nocache; config:*=ttl:10m; feed:*=ttl:5s,max:1000
+
+  nocache   keys matching the pattern are never cached, always fetched from Redis
+  ttl:<d>   cache matching keys for d instead of the global expiry time; either a duration such as 10m, or seconds
+  max:<n>   give matching keys their own capacity of n entries, so they neither evict nor are evicted by other keys
+
+The first rule whose pattern matches a key applies; keys matching no rule use the global settings.
+ */
+
+// A caching policy for keys matching a glob pattern.
+type cacheRule struct {
+	pattern    string
+	prefix     string        // Set if the pattern is a plain prefix followed by "*", to skip glob matching.
+	isPrefix   bool
+	cacheable  bool
+	ttl        time.Duration // Zero means the global expiration time.
+	maxEntries int           // Zero means matching keys share the global capacity.
+	segment    int           // Index of the shard segment that holds matching keys.
+}
+
+func (rule *cacheRule) matches(key string) bool {
+	if rule.isPrefix {
+		return strings.HasPrefix(key, rule.prefix)
+	}
+	return globMatch(rule.pattern, key)
+}
+
+// Parses a rule table in the format described above.
+func parseCacheRules(spec string) ([]cacheRule, error) {
+	var rules []cacheRule
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		separator := strings.LastIndex(entry, "=")
+		if separator <= 0 {
+			return nil, fmt.Errorf("cache rule %q must have the form <pattern>=<settings>", entry)
+		}
+
+		rule := cacheRule{pattern: strings.TrimSpace(entry[:separator]), cacheable: true}
+		rule.prefix, rule.isPrefix = globPrefix(rule.pattern)
+		for _, setting := range strings.Split(entry[separator+1:], ",") {
+			if err := rule.applySetting(strings.TrimSpace(setting)); err != nil {
+				return nil, fmt.Errorf("cache rule %q: %v", entry, err)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (rule *cacheRule) applySetting(setting string) error {
+	name, value := setting, ""
+	if i := strings.Index(setting, ":"); i >= 0 {
+		name, value = setting[:i], setting[i+1:]
+	}
+
+	switch strings.ToLower(name) {
+	case "nocache":
+		rule.cacheable = false
+	case "ttl":
+		ttl, err := parseSecondsOrDuration(value)
+		if err != nil || ttl <= 0 {
+			return fmt.Errorf("invalid ttl %q", value)
+		}
+		rule.ttl = ttl
+	case "max":
+		maxEntries, err := strconv.Atoi(value)
+		if err != nil || maxEntries <= 0 {
+			return fmt.Errorf("invalid max %q", value)
+		}
+		rule.maxEntries = maxEntries
+	default:
+		return fmt.Errorf("unknown setting %q", setting)
+	}
+	return nil
+}
+
+// Parses a Go duration such as "10m", or a plain number of seconds like the other expiry settings.
+func parseSecondsOrDuration(value string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// Returns the first rule matching the key, or nil if none does.
+func (cache *cache) ruleFor(key string) *cacheRule {
+	for i := range cache.rules {
+		if cache.rules[i].matches(key) {
+			return &cache.rules[i]
+		}
+	}
+	return nil
+}
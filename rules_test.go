@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+/**
+Tests for per-namespace cache rules, and the glob matching they use.
+ */
+
+// Checks glob matching against the Redis KEYS syntax.
+func TestGlobMatchFollowsRedisSyntax(t *testing.T) {
+	cases := []struct {
+		pattern, key string
+		expected     bool
+	}{
+		{"*", "", true},
+		{"*", "anything", true},
+		{"session:*", "session:42", true},
+		{"session:*", "sessions:42", false},
+		{"user:*:profile", "user:42:profile", true},
+		{"user:*:profile", "user:42:settings", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{"a\\*b", "a*b", true},
+		{"a\\*b", "axb", false},
+		{"*a*b*", "xxaxxbxx", true},
+		{"*a*b", "xxbxxa", false},
+		{"[unterminated", "[unterminated", true},
+	}
+
+	for _, c := range cases {
+		if matched := globMatch(c.pattern, c.key); matched != c.expected {
+			t.Errorf("Expected globMatch(%q, %q) to be %v", c.pattern, c.key, c.expected)
+		}
+	}
+}
+
+// Checks that only plain prefixes followed by a single "*" are recognized as prefixes.
+func TestGlobPrefixRecognizesPlainPrefixes(t *testing.T) {
+	for pattern, expected := range map[string]string{"session:*": "session:", "*": "", "a?:*": "-", "a*b": "-"} {
+		prefix, ok := globPrefix(pattern)
+		if (expected == "-") == ok || (ok && prefix != expected) {
+			t.Errorf("For pattern %q, expected prefix %q but got %q (%v)", pattern, expected, prefix, ok)
+		}
+	}
+}
+
+// Checks that rule tables are parsed in order, with each setting applied.
+func TestParseCacheRules(t *testing.T) {
+	rules, err := parseCacheRules(" session:*=nocache; config:*=ttl:10m ;feed:*=ttl:5,max:1000;; user:?:*=ttl:30s")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []cacheRule{
+		{pattern: "session:*", prefix: "session:", isPrefix: true, cacheable: false},
+		{pattern: "config:*", prefix: "config:", isPrefix: true, cacheable: true, ttl: 10 * time.Minute},
+		{pattern: "feed:*", prefix: "feed:", isPrefix: true, cacheable: true, ttl: 5 * time.Second, maxEntries: 1000},
+		{pattern: "user:?:*", cacheable: true, ttl: 30 * time.Second},
+	}
+	if fmt.Sprint(rules) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v but got %v", expected, rules)
+	}
+
+	for _, spec := range []string{"session:*", "=nocache", "a:*=ttl:soon", "a:*=max:0", "a:*=cache-forever"} {
+		if _, err := parseCacheRules(spec); err == nil {
+			t.Errorf("Expected an error for rule table %q", spec)
+		}
+	}
+}
+
+// Checks that the first matching rule applies to a key.
+func TestCacheRulesApplyInOrderOfPrecedence(t *testing.T) {
+	rules, _ := parseCacheRules("a:b:*=nocache; a:*=ttl:5")
+	cache := NewCache(redisServer, 2, 60, maxConnections, WithRules(rules))
+	defer cache.Close()
+
+	if cache.cacheable("a:b:c") || !cache.cacheable("a:c") || !cache.cacheable("b") {
+		t.Errorf("Expected only a:b:c to be uncacheable")
+	}
+
+	if cache.expirationTimeFor("a:c") != 5*time.Second || cache.expirationTimeFor("b") != time.Minute {
+		t.Errorf("Expected a:c to expire after 5s and b after the global 60s")
+	}
+}
+
+// Checks that keys matching a nocache rule are always fetched from Redis.
+func TestCacheNeverCachesKeysMatchingNocacheRules(t *testing.T) {
+	rules, _ := parseCacheRules("session:*=nocache")
+	cache := NewCache(redisServer, 2, 60, maxConnections, WithRules(rules), WithNegativeCaching(time.Minute, 2))
+	defer cache.Close()
+	redisDirect.Do("SET", "session:1", "s1")
+	redisDirect.Do("DEL", "session:missing")
+
+	for i := 0; i < 2; i++ {
+		if value, status, _ := cache.get("session:1"); status != statusMiss || value != "s1" {
+			t.Errorf("Expected session:1 to be fetched from Redis every time, got %v %q", status, value)
+		}
+	}
+
+	cache.get("session:missing")
+	if cache.GetSize() != 0 || len(cache.shards[0].key2ElementMap) != 0 {
+		t.Errorf("Expected nothing to be cached for session keys")
+	}
+}
+
+// Checks that keys matching a rule with a ttl expire after it, rather than the global expiry time.
+func TestCacheUsesRuleTTL(t *testing.T) {
+	rules, _ := parseCacheRules("feed:*=ttl:1")
+	cache := NewCache(redisServer, 2, 60, maxConnections, WithRules(rules))
+	defer cache.Close()
+	redisDirect.Do("SET", "feed:1", "f1")
+
+	cache.get("feed:1")
+	cache.putInCache(k1, v1)
+	time.Sleep(1100 * time.Millisecond)
+
+	if _, status := cache.fetchFromCache("feed:1"); status != statusMiss {
+		t.Errorf("Expected feed:1 to expire after the rule's 1s ttl, got %v", status)
+	}
+
+	if !cacheHolds(cache, k1, v1) {
+		t.Errorf("Expected k1 to remain cached for the global expiry time")
+	}
+}
+
+// Checks that keys matching a rule with max entries only evict, and are only evicted by, each other.
+func TestCacheGivesRulesWithMaxEntriesTheirOwnCapacity(t *testing.T) {
+	rules, _ := parseCacheRules("feed:*=max:2")
+	cache := NewCache(redisServer, 2, 60, maxConnections, WithRules(rules))
+	defer cache.Close()
+
+	cache.putInCache(k1, v1)
+	cache.putInCache(k2, v2)
+	for i := 1; i <= 3; i++ {
+		cache.putInCache(fmt.Sprintf("feed:%d", i), "f")
+	}
+
+	if !(cacheHolds(cache, k1, v1) && cacheHolds(cache, k2, v2)) {
+		t.Errorf("Feed keys should not evict other keys")
+	}
+
+	if _, status := cache.fetchFromCache("feed:1"); status != statusMiss {
+		t.Errorf("Expected the least recently used feed key to be evicted")
+	}
+
+	if !(cacheHolds(cache, "feed:2", "f") && cacheHolds(cache, "feed:3", "f")) {
+		t.Errorf("Expected the two most recent feed keys to be cached")
+	}
+
+	cache.putInCache(k3, v3)
+	if !(cacheHolds(cache, "feed:2", "f") && cacheHolds(cache, "feed:3", "f")) {
+		t.Errorf("Other keys should not evict feed keys")
+	}
+
+	if cache.GetSize() != 4 {
+		t.Errorf("Expected 2 feed keys and 2 other keys to be cached, got %d", cache.GetSize())
+	}
+	checkListMatchesMap(t, cache)
+}
+
+// Checks that a rule with fewer max entries than there are shards can still cache its keys in every shard.
+func TestCacheGivesEveryShardRoomForRulesWithFewMaxEntries(t *testing.T) {
+	rules, _ := parseCacheRules("feed:*=max:2")
+	cache := NewCache(redisServer, 8, 60, maxConnections, WithRules(rules), WithShards(4))
+	defer cache.Close()
+
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("feed:%d", i)
+		cache.putInCache(key, "f")
+		if !cacheHolds(cache, key, "f") {
+			t.Errorf("Expected %s to be cached, whichever shard holds it", key)
+		}
+	}
+	if evictions := cache.GetStats().Evictions; evictions != 16 {
+		t.Errorf("Expected 16 feed keys to be evicted, one per shard past the first 4, got %d", evictions)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+// S3-FIFO (Yang et al.). New entries go into a small FIFO queue holding a tenth of the capacity. Entries that are read
+// again before reaching its end move to the main FIFO queue, and the rest are evicted, their keys remembered in a
+// ghost queue; a key that comes back while still a ghost goes straight to the main queue. Entries at the end of the
+// main queue are reinserted at its start if they were read since, so frequently read entries stay. Reads only bump a
+// small counter, never reorder a queue.
+type s3FIFOPolicy struct {
+	small, main   nodeList
+	ghosts        *ghostList
+	smallCapacity int
+	ghostCapacity int
+}
+
+// Which of an S3-FIFO policy's queues a node is in.
+const (
+	s3FIFOSmall = iota
+	s3FIFOMain
+)
+
+// How many reads an S3-FIFO entry's counter records.
+const s3FIFOMaxFreq = 3
+
+func newS3FIFOPolicy(capacity int) evictionPolicy {
+	return &s3FIFOPolicy{
+		ghosts:        newGhostList(),
+		smallCapacity: maxInt(1, capacity/10),
+		ghostCapacity: capacity,
+	}
+}
+
+func (policy *s3FIFOPolicy) add(n *node) {
+	n.freq = 0
+	if policy.ghosts.contains(n.key) {
+		policy.ghosts.remove(n.key)
+		n.queue = s3FIFOMain
+		policy.main.insertNodeAtListFront(n)
+		return
+	}
+
+	n.queue = s3FIFOSmall
+	policy.small.insertNodeAtListFront(n)
+}
+
+func (policy *s3FIFOPolicy) touch(n *node) {
+	if n.freq < s3FIFOMaxFreq {
+		n.freq++
+	}
+}
+
+func (policy *s3FIFOPolicy) remove(n *node) {
+	if n.queue == s3FIFOMain {
+		policy.main.removeNodeFromList(n)
+	} else {
+		policy.small.removeNodeFromList(n)
+	}
+}
+
+func (policy *s3FIFOPolicy) evict() *node {
+	for {
+		if policy.small.len >= policy.smallCapacity || policy.main.len == 0 {
+			tail := policy.small.removeNodeFromList(policy.small.tail)
+			if tail.freq > 0 {
+				tail.freq = 0
+				tail.queue = s3FIFOMain
+				policy.main.insertNodeAtListFront(tail)
+				continue
+			}
+
+			policy.ghosts.push(tail.key)
+			policy.ghosts.trimTo(policy.ghostCapacity)
+			return tail
+		}
+
+		tail := policy.main.removeNodeFromList(policy.main.tail)
+		if tail.freq > 0 {
+			tail.freq--
+			policy.main.insertNodeAtListFront(tail)
+			continue
+		}
+		return tail
+	}
+}
+
+func (policy *s3FIFOPolicy) each(fn func(n *node) bool) {
+	if policy.main.each(fn) {
+		policy.small.each(fn)
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// A group of a shard's entries that share a capacity, with its own eviction policy. Entries only ever evict other
+// entries of the same segment. A segment is bounded by entry count, by bytes, or both; with a byte limit, a capacity
+// of zero means the entry count is not limited.
+type segment struct {
+	policy   evictionPolicy
+	len      int
+	bytes    int
+	capacity int
+	maxBytes int
+}
+
+// The limits of one segment of a shard.
+type segmentLimits struct {
+	entries, bytes int
+}
+
+// Reports whether the segment holds more entries or bytes than its limits allow.
+func (segment *segment) overLimit() bool {
+	if segment.maxBytes > 0 {
+		return segment.bytes > segment.maxBytes || (segment.capacity > 0 && segment.len > segment.capacity)
+	}
+	return segment.len > segment.capacity
+}
+
+// Approximate memory used by a node besides its key and value: the node itself, and its entry in key2ElementMap.
+const nodeOverhead = int(unsafe.Sizeof(node{})) + 48
+
+// Entry size assumed when sizing the eviction policy of a segment limited by bytes alone.
+const assumedEntryBytes = nodeOverhead + 256
+
+// Returns the approximate memory used by a cached node, counting its key, value and overhead.
+func (n *node) size() int {
+	return len(n.key) + len(n.value) + nodeOverhead
+}
+
+// Segments every shard has. Keys matching a cache rule with its own max entries are held in further segments, one
+// per such rule.
+const (
+	valuesSegment   = iota // Values of keys that don't have a segment of their own.
+	negativeSegment        // Keys known to be missing from Redis.
+)
+
+// One independently locked partition of the cache. Each shard holds its own map and its own slice of the cache's
+// capacity, so requests for keys in different shards never wait on each other. Entries are split into segments with
+// separate capacities, so that for example lookups of nonexistent keys cannot evict values.
+type shard struct {
+	mu             sync.Mutex
+	key2ElementMap map[string]*node
+	segments       []*segment
+	// Reads a value needs before it is refreshed ahead of expiring.
+	refreshAheadHits int
+	// Fetches and writes in flight, by key. Values fetched from Redis are only cached if no write of their key
+	// completed while they were being fetched, as they may predate it.
+	inFlight map[string]*inFlight
+	// Count entries evicted to make room, and entries removed once expired.
+	evictions, expirations int64
+}
+
+// The fetches and writes of a key that have begun and not yet updated its entry. version counts the writes and
+// invalidations of the key that completed meanwhile. Keys are only tracked while they have some in flight.
+type inFlight struct {
+	count   int
+	version uint64
+}
+
+// Creates a shard with a segment for each of the given limits, each evicting entries by a policy from newPolicy.
+func newShard(limits []segmentLimits, newPolicy policyFactory) *shard {
+	s := new(shard)
+	s.key2ElementMap = make(map[string]*node)
+	s.inFlight = make(map[string]*inFlight)
+	for _, limit := range limits {
+		expectedEntries := limit.entries
+		if expectedEntries <= 0 && limit.bytes > 0 {
+			expectedEntries = limit.bytes / assumedEntryBytes
+		}
+
+		s.segments = append(s.segments, &segment{
+			policy:   newPolicy(expectedEntries),
+			capacity: limit.entries,
+			maxBytes: limit.bytes,
+		})
+	}
+	return s
+}
+
+// Returns the number of values in the shard, not counting negative entries.
+func (shard *shard) size() int {
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	size := 0
+	for i, segment := range shard.segments {
+		if i != negativeSegment {
+			size += segment.len
+		}
+	}
+	return size
+}
+
+// Returns the approximate memory used by all entries in the shard, including negative ones.
+func (shard *shard) bytes() int {
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	bytes := 0
+	for _, segment := range shard.segments {
+		bytes += segment.bytes
+	}
+	return bytes
+}
+
+// Returns the number of entries the shard has evicted, and removed once expired.
+func (shard *shard) removals() (evictions, expirations int64) {
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	return shard.evictions, shard.expirations
+}
+
+// Looks the key up in the shard. Returns statusHit and the value for a cached value, statusNotFound for a negative
+// entry, statusStale and the value for an expired value within its revalidation window, and statusMiss if the key is
+// not cached or its entry has expired. Reads of found entries are counted and reported to their segment's eviction
+// policy, and expired entries are removed once past their stale windows. refresh is true if the caller should refresh
+// the value in the background, because it is stale or hot and about to expire; the node is then marked as refreshing,
+// so that only one caller is asked to.
+func (shard *shard) fetch(key string) (value string, status lookupStatus, refresh bool) {
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	foundNode, ok := shard.key2ElementMap[key]
+	if !ok {
+		return "", statusMiss, false
+	}
+
+	status = statusHit
+	now := time.Now()
+	if now.After(foundNode.expiresAt) {
+		if now.After(foundNode.retainedUntil()) {
+			shard.removeNode(foundNode)
+			shard.expirations++
+			return "", statusMiss, false
+		}
+
+		if now.After(foundNode.staleUntil) {
+			return "", statusMiss, false
+		}
+		status = statusStale
+	}
+
+	foundNode.hits++
+	foundNode.lastAccess = now
+	shard.segments[foundNode.segment].policy.touch(foundNode)
+	if foundNode.negative {
+		return "", statusNotFound, false
+	}
+
+	if !foundNode.refreshing && (status == statusStale || foundNode.dueForRefreshAhead(now, shard.refreshAheadHits)) {
+		foundNode.refreshing = true
+		refresh = true
+	}
+	return foundNode.value, status, refresh
+}
+
+// Places a node in the shard by adding it to its segment's eviction policy, and mapping its key to it in
+// key2ElementMap. Any existing node for the key is replaced, which happens when concurrent requests miss on the same
+// key and both fetch it from Redis. Then, for as long as the segment is over its limits, the node its policy picks is
+// evicted. A node larger than the segment's whole byte limit is not cached at all, rather than flushing the segment.
+func (shard *shard) put(newNode *node) {
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	shard.insert(newNode)
+}
+
+// Does the work of put. The caller must hold shard.mu.
+func (shard *shard) insert(newNode *node) {
+	if oldNode, ok := shard.key2ElementMap[newNode.key]; ok {
+		shard.removeNode(oldNode)
+	}
+
+	segment := shard.segments[newNode.segment]
+	if segment.maxBytes > 0 && newNode.size() > segment.maxBytes {
+		return
+	}
+
+	segment.policy.add(newNode)
+	segment.len++
+	segment.bytes += newNode.size()
+	shard.key2ElementMap[newNode.key] = newNode
+
+	for segment.len > 0 && segment.overLimit() {
+		victim := segment.policy.evict()
+		segment.len--
+		segment.bytes -= victim.size()
+		delete(shard.key2ElementMap, victim.key)
+		shard.evictions++
+	}
+}
+
+// Records that a fetch or write of the key begins, which must end with a call to fill, write or abandon. Returns the
+// key's version, to be passed to that call.
+func (shard *shard) begin(key string) uint64 {
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	op, ok := shard.inFlight[key]
+	if !ok {
+		op = new(inFlight)
+		shard.inFlight[key] = op
+	}
+	op.count++
+	return op.version
+}
+
+// Records that a fetch or write of the key that began at version has ended. Returns whether the key was written or
+// invalidated in between. The caller must hold shard.mu.
+func (shard *shard) end(key string, version uint64) (changed bool) {
+	op := shard.inFlight[key]
+	changed = op.version != version
+	if op.count--; op.count == 0 {
+		delete(shard.inFlight, key)
+	}
+	return changed
+}
+
+// Keeps the fetches and writes of the key in flight from caching what they fetched or wrote. The caller must hold
+// shard.mu.
+func (shard *shard) changed(key string) {
+	if op, ok := shard.inFlight[key]; ok {
+		op.version++
+	}
+}
+
+// Ends a fetch or write of the key that failed, leaving its entry as it is.
+func (shard *shard) abandon(key string) {
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	shard.end(key, 0)
+}
+
+// Caches the result of a fetch from Redis for the key: the node, or nothing if it is nil, replacing any entry the key
+// had. Does nothing if a write of the key completed since the fetch began at version, as the fetched result may
+// predate it.
+func (shard *shard) fill(key string, newNode *node, version uint64) {
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if shard.end(key, version) {
+		return
+	}
+
+	if newNode != nil {
+		shard.insert(newNode)
+	} else if oldNode, ok := shard.key2ElementMap[key]; ok {
+		shard.removeNode(oldNode)
+	}
+}
+
+// Updates the key's entry after writing it to Redis: caches the written node, or removes the entry if it is nil, or
+// if another write of the key completed since this one began at version, since the two writes may have reached Redis
+// in either order. Fetches and writes of the key still in flight are then kept from caching their results.
+func (shard *shard) write(key string, newNode *node, version uint64) {
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if !shard.end(key, version) && newNode != nil {
+		shard.insert(newNode)
+	} else if oldNode, ok := shard.key2ElementMap[key]; ok {
+		shard.removeNode(oldNode)
+	}
+	shard.changed(key)
+}
+
+// Removes all trace of the key value pairing associated with the input key.
+func (shard *shard) removeKey(key string) {
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if targetNode, ok := shard.key2ElementMap[key]; ok {
+		shard.removeNode(targetNode)
+	}
+}
+
+// Removes the key's entry, and keeps fetches of it in flight from caching what they fetched, like a write would.
+// Fetches and writes of other keys are left alone. Returns whether the key had an entry.
+func (shard *shard) invalidate(key string) bool {
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	targetNode, ok := shard.key2ElementMap[key]
+	if ok {
+		shard.removeNode(targetNode)
+	}
+	shard.changed(key)
+	return ok
+}
+
+// Removes every entry, negative ones included, and keeps fetches in flight from caching what they fetched. Returns the
+// number of entries removed.
+func (shard *shard) removeAll() int {
+	return shard.removeMatching(func(string) bool { return true })
+}
+
+// Removes the entries of keys that match, negative ones included, and keeps fetches in flight from caching what they
+// fetched. Returns the number of entries removed. Takes time linear in the number of entries.
+func (shard *shard) removeMatching(matches func(key string) bool) int {
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	removed := 0
+	for key, targetNode := range shard.key2ElementMap {
+		if matches(key) {
+			shard.removeNode(targetNode)
+			removed++
+		}
+	}
+	for key, op := range shard.inFlight {
+		if matches(key) {
+			op.version++
+		}
+	}
+	return removed
+}
+
+// Removes a node from both its segment and the map. The caller must hold shard.mu.
+func (shard *shard) removeNode(targetNode *node) {
+	segment := shard.segments[targetNode.segment]
+	segment.policy.remove(targetNode)
+	segment.len--
+	segment.bytes -= targetNode.size()
+	delete(shard.key2ElementMap, targetNode.key)
+}
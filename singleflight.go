@@ -0,0 +1,48 @@
+package main
+
+import "sync"
+
+// A Redis fetch in progress. Requests that miss on the same key while it is in flight wait for it and share its
+// result, instead of each sending their own GET to Redis.
+type flight struct {
+	wg    sync.WaitGroup
+	value string
+	err   error
+	dups  int
+}
+
+// Tracks in-flight fetches by key, so that there is at most one per key at a time.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// Runs fetch for the key, unless a fetch for the same key is already in flight, in which case it waits for that one
+// and returns its result. shared reports whether the result came from another caller's fetch.
+func (group *flightGroup) do(key string, fetch func() (string, error)) (value string, err error, shared bool) {
+	group.mu.Lock()
+	if group.flights == nil {
+		group.flights = make(map[string]*flight)
+	}
+
+	if f, ok := group.flights[key]; ok {
+		f.dups++
+		group.mu.Unlock()
+		f.wg.Wait()
+		return f.value, f.err, true
+	}
+
+	f := new(flight)
+	f.wg.Add(1)
+	group.flights[key] = f
+	group.mu.Unlock()
+
+	f.value, f.err = fetch()
+	f.wg.Done()
+
+	group.mu.Lock()
+	delete(group.flights, key)
+	group.mu.Unlock()
+
+	return f.value, f.err, false
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Checks that concurrent calls for the same key run the fetch once, and all receive its result.
+func TestFlightGroupSharesConcurrentFetches(t *testing.T) {
+	var group flightGroup
+	var fetches int32
+	release := make(chan struct{})
+	fetch := func() (string, error) {
+		atomic.AddInt32(&fetches, 1)
+		<-release
+		return "v", nil
+	}
+
+	const callers = 10
+	var wg sync.WaitGroup
+	var sharedCount int32
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, err, shared := group.do("k", fetch)
+			if value != "v" || err != nil {
+				t.Errorf("Expected v but got %q (%v)", value, err)
+			}
+			if shared {
+				atomic.AddInt32(&sharedCount, 1)
+			}
+		}()
+	}
+
+	// Wait until every other caller has joined the in-flight fetch before letting it finish.
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		group.mu.Lock()
+		f := group.flights["k"]
+		joined := f != nil && f.dups == callers-1
+		group.mu.Unlock()
+		if joined {
+			break
+		}
+	}
+	close(release)
+	wg.Wait()
+
+	if fetches != 1 {
+		t.Errorf("Expected a single fetch, got %d", fetches)
+	}
+
+	if sharedCount != callers-1 {
+		t.Errorf("Expected %d callers to share the fetch, got %d", callers-1, sharedCount)
+	}
+
+	if len(group.flights) != 0 {
+		t.Errorf("Expected no fetches left in flight")
+	}
+}
+
+// Checks that fetches for different keys, and later fetches for the same key, are not shared.
+func TestFlightGroupOnlySharesInFlightFetchesOfTheSameKey(t *testing.T) {
+	var group flightGroup
+	for _, key := range []string{"a", "b", "a"} {
+		key := key
+		value, _, shared := group.do(key, func() (string, error) { return key, nil })
+		if value != key || shared {
+			t.Errorf("For key %s, expected an unshared fetch of %s but got %s (shared: %v)", key, key, value, shared)
+		}
+	}
+}
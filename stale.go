@@ -0,0 +1,49 @@
+package main
+
+import "time"
+
+/**
+Stale serving keeps expired values around for a while longer. Within the stale-while-revalidate window after a value
+expires, requests are served the expired value right away, and the first of them triggers a single refresh from Redis
+in the background (see refresh.go), so hot keys don't make requests wait on Redis whenever they expire. Within the stale-if-error
+window, the expired value is served whenever fetching the key from Redis fails, so the proxy rides out Redis outages
+for keys it has seen recently. Negative entries are never served stale.
+ */
+
+// Serves values for up to window after they expire, while they are refreshed from Redis in the background.
+func WithStaleWhileRevalidate(window time.Duration) option {
+	return func(c *cache) {
+		c.staleWhileRevalidate = window
+	}
+}
+
+// Serves values for up to window after they expire when they cannot be fetched from Redis.
+func WithStaleIfError(window time.Duration) option {
+	return func(c *cache) {
+		c.staleIfError = window
+	}
+}
+
+// Returns when the node may last be served, stale or not, after which it can be removed.
+func (n *node) retainedUntil() time.Time {
+	retainedUntil := n.expiresAt
+	if n.staleUntil.After(retainedUntil) {
+		retainedUntil = n.staleUntil
+	}
+	if n.staleIfErrorUntil.After(retainedUntil) {
+		retainedUntil = n.staleIfErrorUntil
+	}
+	return retainedUntil
+}
+
+// Returns the key's expired value if it is still within its stale-if-error window.
+func (shard *shard) fetchStaleIfError(key string) (string, bool) {
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	foundNode, ok := shard.key2ElementMap[key]
+	if !ok || foundNode.negative || time.Now().After(foundNode.staleIfErrorUntil) {
+		return "", false
+	}
+	return foundNode.value, true
+}
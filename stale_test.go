@@ -0,0 +1,121 @@
+package main
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Checks that an expired value within its revalidation window is served straight away, without waiting on Redis,
+// and is then replaced by a single background refresh.
+func TestCacheServesStaleValueWhileRevalidating(t *testing.T) {
+	cache := NewCache(redisServer, 2, 60, maxConnections, WithStaleWhileRevalidate(time.Minute))
+	defer cache.Close()
+	redisDirect.Do("SET", "stale", "new")
+	cache.putInCacheWithTTL("stale", "old", 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+
+	// Holding every pooled connection makes any request that waits on Redis block.
+	var borrowed []redis.Conn
+	for i := 0; i < maxConnections; i++ {
+		conn := cache.pool.Get()
+		conn.Do("PING")
+		borrowed = append(borrowed, conn)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if value, status, _ := cache.get("stale"); value != "old" || status != statusStale {
+				t.Errorf("Expected the stale value, got %q %v", value, status)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if !nodeRefreshing(cache, "stale") {
+		t.Errorf("Expected a refresh to be under way")
+	}
+
+	for _, conn := range borrowed {
+		conn.Close()
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for !cacheHolds(cache, "stale", "new") && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !cacheHolds(cache, "stale", "new") {
+		t.Errorf("Expected the background refresh to cache the new value")
+	}
+}
+
+// Reports whether the key's node is marked as being refreshed in the background.
+func nodeRefreshing(cache *cache, key string) bool {
+	shard := cache.shardFor(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	foundNode, ok := shard.key2ElementMap[key]
+	return ok && foundNode.refreshing
+}
+
+// Checks that a stale value is dropped when the refresh finds the key gone from Redis.
+func TestCacheDropsStaleValueOfDeletedKey(t *testing.T) {
+	cache := NewCache(redisServer, 2, 60, maxConnections, WithStaleWhileRevalidate(time.Minute))
+	defer cache.Close()
+	redisDirect.Do("DEL", "deleted")
+	cache.putInCacheWithTTL("deleted", "old", 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+
+	cache.get("deleted")
+	deadline := time.Now().Add(time.Second)
+	for cache.GetSize() != 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, status, _ := cache.get("deleted"); status != statusNotFound {
+		t.Errorf("Expected the deleted key not to be found, got %v", status)
+	}
+}
+
+// Checks that an expired value is served when Redis fails only within its stale-if-error window, and that expired
+// values are not served otherwise.
+func TestCacheServesStaleValueIfRedisFails(t *testing.T) {
+	cache := NewCache(redisServer, 2, 60, maxConnections, WithStaleIfError(200*time.Millisecond))
+	defer cache.Close()
+	cache.putInCacheWithTTL(k1, v1, 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+
+	if _, status := cache.fetchFromCache(k1); status != statusMiss {
+		t.Errorf("Expected the expired value not to be served while Redis is up, got %v", status)
+	}
+
+	cache.pool.Close()
+	if value, status, _ := cache.get(k1); value != v1 || status != statusStale {
+		t.Errorf("Expected the stale value while Redis is failing, got %q %v", value, status)
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	if _, status, _ := cache.get(k1); status != statusError {
+		t.Errorf("Expected an error past the stale-if-error window, got %v", status)
+	}
+}
+
+// Checks that the janitor keeps expired entries that are still within a stale window.
+func TestJanitorKeepsEntriesWithinStaleWindows(t *testing.T) {
+	cache := newPolicyTestCache(10, newLRUPolicy)
+	shard := cache.shards[0]
+	n := newNode(k1, v1, -time.Second, valuesSegment)
+	n.staleIfErrorUntil = time.Now().Add(time.Minute)
+	shard.put(n)
+
+	if _, expired := shard.removeExpired(10, time.Now()); expired != 0 || shard.size() != 1 {
+		t.Errorf("Expected the entry to be kept for its stale-if-error window")
+	}
+
+	if _, expired := shard.removeExpired(10, time.Now().Add(2*time.Minute)); expired != 1 {
+		t.Errorf("Expected the entry to be removed past its stale-if-error window")
+	}
+}
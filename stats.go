@@ -0,0 +1,33 @@
+package main
+
+import "sync/atomic"
+
+// Counters describing what the cache has been doing. The cache's copy is updated atomically while requests are
+// served; GetStats returns a consistent snapshot of each counter.
+type cacheStats struct {
+	// Lookups answered from the cache, including stale values and keys cached as missing from Redis.
+	Hits int64
+	// Lookups that had to go to Redis, including those of keys that are never cached.
+	Misses int64
+	// Requests that missed the cache and waited for another request's in-flight Redis fetch of the same key,
+	// instead of sending their own.
+	Coalesced int64
+	// Entries evicted to make room for others, and entries removed once expired, either when looked up or by the
+	// janitor. Counted by each shard, and summed by GetStats.
+	Evictions   int64
+	Expirations int64
+}
+
+func (cache *cache) GetStats() cacheStats {
+	stats := cacheStats{
+		Hits:      atomic.LoadInt64(&cache.stats.Hits),
+		Misses:    atomic.LoadInt64(&cache.stats.Misses),
+		Coalesced: atomic.LoadInt64(&cache.stats.Coalesced),
+	}
+	for _, shard := range cache.shards {
+		evictions, expirations := shard.removals()
+		stats.Evictions += evictions
+		stats.Expirations += expirations
+	}
+	return stats
+}
@@ -0,0 +1,167 @@
+package main
+
+import "hash/fnv"
+
+// W-TinyLFU, as in Caffeine. New entries go into a small LRU window, and entries pushed out of the window join the
+// probation part of a segmented LRU. An entry read while on probation is promoted to the protected part. When the
+// cache is full, the newest entry on probation competes with the oldest, and whichever has been read less often
+// recently, as estimated by a count-min sketch of every access, is evicted. Keys read once never build up enough
+// frequency to displace a popular entry.
+type tinyLFUPolicy struct {
+	window, probation, protected nodeList
+	windowCapacity               int
+	protectedCapacity            int
+	sketch                       *countMinSketch
+}
+
+// Which of a W-TinyLFU policy's lists a node is in.
+const (
+	tinyLFUWindow = iota
+	tinyLFUProbation
+	tinyLFUProtected
+)
+
+func newTinyLFUPolicy(capacity int) evictionPolicy {
+	windowCapacity := maxInt(1, capacity/100)
+	return &tinyLFUPolicy{
+		windowCapacity:    windowCapacity,
+		protectedCapacity: (capacity - windowCapacity) * 8 / 10,
+		sketch:            newCountMinSketch(capacity),
+	}
+}
+
+func (policy *tinyLFUPolicy) add(n *node) {
+	policy.sketch.increment(n.key)
+	n.queue = tinyLFUWindow
+	policy.window.insertNodeAtListFront(n)
+
+	if policy.window.len > policy.windowCapacity {
+		candidate := policy.window.removeNodeFromList(policy.window.tail)
+		candidate.queue = tinyLFUProbation
+		policy.probation.insertNodeAtListFront(candidate)
+	}
+}
+
+func (policy *tinyLFUPolicy) touch(n *node) {
+	policy.sketch.increment(n.key)
+	switch n.queue {
+	case tinyLFUWindow:
+		policy.window.moveToFront(n)
+	case tinyLFUProtected:
+		policy.protected.moveToFront(n)
+	case tinyLFUProbation:
+		policy.probation.removeNodeFromList(n)
+		n.queue = tinyLFUProtected
+		policy.protected.insertNodeAtListFront(n)
+
+		if policy.protected.len > policy.protectedCapacity {
+			demoted := policy.protected.removeNodeFromList(policy.protected.tail)
+			demoted.queue = tinyLFUProbation
+			policy.probation.insertNodeAtListFront(demoted)
+		}
+	}
+}
+
+func (policy *tinyLFUPolicy) remove(n *node) {
+	policy.list(n).removeNodeFromList(n)
+}
+
+func (policy *tinyLFUPolicy) evict() *node {
+	if policy.probation.len == 0 {
+		if policy.protected.len > 0 {
+			return policy.protected.removeNodeFromList(policy.protected.tail)
+		}
+		return policy.window.removeNodeFromList(policy.window.tail)
+	}
+
+	candidate, victim := policy.probation.head, policy.probation.tail
+	if candidate != victim && policy.sketch.estimate(candidate.key) <= policy.sketch.estimate(victim.key) {
+		victim = candidate
+	}
+	return policy.probation.removeNodeFromList(victim)
+}
+
+func (policy *tinyLFUPolicy) each(fn func(n *node) bool) {
+	if policy.protected.each(fn) && policy.window.each(fn) {
+		policy.probation.each(fn)
+	}
+}
+
+func (policy *tinyLFUPolicy) list(n *node) *nodeList {
+	switch n.queue {
+	case tinyLFUWindow:
+		return &policy.window
+	case tinyLFUProtected:
+		return &policy.protected
+	}
+	return &policy.probation
+}
+
+// Rows in a count-min sketch, each hashing keys differently.
+const sketchDepth = 4
+
+// Estimates how often each key was accessed recently in a fixed amount of memory. Each key increments one counter in
+// every row, and its estimate is the smallest of them, which collisions can only inflate. Counters saturate at 15, and
+// after 10 accesses per counter width all of them are halved, so the estimates favor recent activity.
+type countMinSketch struct {
+	rows       [sketchDepth][]uint8
+	mask       uint64
+	additions  int
+	sampleSize int
+}
+
+func newCountMinSketch(capacity int) *countMinSketch {
+	width := 16
+	for width < capacity {
+		width *= 2
+	}
+
+	sketch := &countMinSketch{mask: uint64(width - 1), sampleSize: 10 * width}
+	for i := range sketch.rows {
+		sketch.rows[i] = make([]uint8, width)
+	}
+	return sketch
+}
+
+// Returns the index of the key's counter in each row.
+func (sketch *countMinSketch) indexes(key string) [sketchDepth]uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+	sum := hash.Sum64()
+
+	// Derives the row hashes from two halves of one hash, as in Kirsch and Mitzenmacher.
+	h1, h2 := sum, sum>>32|sum<<32
+	var indexes [sketchDepth]uint64
+	for i := range indexes {
+		indexes[i] = (h1 + uint64(i)*h2) & sketch.mask
+	}
+	return indexes
+}
+
+func (sketch *countMinSketch) increment(key string) {
+	for i, index := range sketch.indexes(key) {
+		if sketch.rows[i][index] < 15 {
+			sketch.rows[i][index]++
+		}
+	}
+
+	sketch.additions++
+	if sketch.additions >= sketch.sampleSize {
+		sketch.additions = 0
+		for _, row := range sketch.rows {
+			for i := range row {
+				row[i] /= 2
+			}
+		}
+	}
+}
+
+func (sketch *countMinSketch) estimate(key string) uint8 {
+	min := uint8(15)
+	for i, index := range sketch.indexes(key) {
+		if count := sketch.rows[i][index]; count < min {
+			min = count
+		}
+	}
+	return min
+}
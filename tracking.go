@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"github.com/gomodule/redigo/redis"
+	"sync/atomic"
+	"time"
+)
+
+/**
+Server-assisted client-side caching, available from Redis 6, is the other source of invalidations (see
+invalidation.go). With CLIENT TRACKING enabled on a connection, Redis remembers the keys read over it, and when one of
+them changes, sends its name on the __redis__:invalidate channel to the connection the tracking is redirected to, which
+is the listener's. Unlike keyspace notifications, this needs no configuration of the server, and only the keys the
+cache has read are reported.
+
+By default, every connection in the cache's pool is tracked, redirected to the listener's current connection. When the
+listener resubscribes on a new connection, pool connections tracked for the old one are replaced as they are next
+borrowed. In broadcast mode (BCAST), Redis instead reports changes to all keys starting with one of the configured
+prefixes, or to all keys if there are none, whether the cache read them or not. Only the listener's own connection
+then needs tracking enabled, redirected to itself.
+ */
+
+const trackingChannel = "__redis__:invalidate"
+
+var errTrackingRedirected = errors.New("connection tracked for an earlier subscription")
+
+type clientTracking struct {
+	bcast    bool
+	prefixes []string
+	redirect int64 // ID of the listener's connection, or 0 while there is none. Accessed atomically.
+}
+
+// A pool connection, with tracking redirected to the connection with ID redirect, or untracked if redirect is 0.
+type trackedConn struct {
+	redis.Conn
+	redirect int64
+}
+
+func newClientTracking(bcast bool, prefixes []string) *clientTracking {
+	return &clientTracking{bcast: bcast, prefixes: prefixes}
+}
+
+// Keeps the connection usable for calls with timeouts, which redis.Conn alone doesn't expose.
+func (conn trackedConn) DoWithTimeout(timeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+	return redis.DoWithTimeout(conn.Conn, timeout, cmd, args...)
+}
+
+func (conn trackedConn) ReceiveWithTimeout(timeout time.Duration) (interface{}, error) {
+	return redis.ReceiveWithTimeout(conn.Conn, timeout)
+}
+
+// Subscribes to invalidation messages. In broadcast mode, enables tracking of the prefixes on this connection first;
+// otherwise, redirects the tracking of pool connections dialed from now on to this one.
+func (tracking *clientTracking) subscribe(conn redis.Conn) error {
+	id, err := redis.Int64(conn.Do("CLIENT", "ID"))
+	if err != nil {
+		return err
+	}
+
+	if tracking.bcast {
+		args := []interface{}{"TRACKING", "ON", "REDIRECT", id, "BCAST"}
+		for _, prefix := range tracking.prefixes {
+			args = append(args, "PREFIX", prefix)
+		}
+		if _, err := conn.Do("CLIENT", args...); err != nil {
+			return err
+		}
+	} else {
+		// Fail here, rather than on every dial, if Redis doesn't support tracking.
+		if _, err := conn.Do("CLIENT", "TRACKING", "OFF"); err != nil {
+			return err
+		}
+		atomic.StoreInt64(&tracking.redirect, id)
+	}
+
+	conn.Send("SUBSCRIBE", trackingChannel)
+	return conn.Flush()
+}
+
+// Removes the keys named by an invalidation message. Redis sends a null message when the database is flushed, which
+// empties the cache.
+func (tracking *clientTracking) invalidate(cache *cache, channel string, data interface{}) {
+	if channel != trackingChannel {
+		return
+	}
+
+	keys, err := redis.Strings(data, nil)
+	if data == nil || err != nil {
+		cache.removeAll()
+		return
+	}
+	for _, key := range keys {
+		cache.invalidate(key)
+	}
+}
+
+func (tracking *clientTracking) unsubscribed() {
+	atomic.StoreInt64(&tracking.redirect, 0)
+}
+
+// Enables tracking on the pool's connections as they are dialed, redirected to the listener's connection, and replaces
+// connections tracked for an earlier one as they are borrowed. Connections dialed while the listener has no connection
+// are left untracked, as what is read over them is dropped from the cache once the listener subscribes again.
+func (tracking *clientTracking) preparePool(pool *redis.Pool) {
+	if tracking.bcast {
+		return
+	}
+
+	dial := pool.Dial
+	pool.Dial = func() (redis.Conn, error) {
+		conn, err := dial()
+		if err != nil {
+			return nil, err
+		}
+
+		redirect := atomic.LoadInt64(&tracking.redirect)
+		if redirect != 0 {
+			// Fails if the listener's connection was closed, in which case it is about to subscribe again.
+			if _, err := conn.Do("CLIENT", "TRACKING", "ON", "REDIRECT", redirect); err != nil {
+				redirect = 0
+			}
+		}
+		return trackedConn{Conn: conn, redirect: redirect}, nil
+	}
+
+	pool.TestOnBorrow = func(conn redis.Conn, _ time.Time) error {
+		if tracked, ok := conn.(trackedConn); !ok || tracked.redirect != atomic.LoadInt64(&tracking.redirect) {
+			return errTrackingRedirected
+		}
+		return nil
+	}
+}
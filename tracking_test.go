@@ -0,0 +1,292 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+/**
+Tests for invalidation by client tracking. The Redis store used by the other tests doesn't support tracking, so these
+run against a fake Redis 6 that serves GET and PTTL, tracks the keys each connection reads or the prefixes it
+broadcasts, and sends invalidation messages the way Redis does when SET is called on it.
+ */
+
+type fakeTrackingRedis struct {
+	listener net.Listener
+	mu       sync.Mutex
+	values   map[string]string
+	nextID   int64
+	clients  map[int64]*fakeTrackingClient
+}
+
+type fakeTrackingClient struct {
+	id         int64
+	conn       net.Conn
+	writer     *respWriter
+	redirect   int64 // 0 if tracking is off.
+	bcast      bool
+	prefixes   []string
+	read       map[string]bool
+	subscribed bool
+}
+
+// Starts a fake Redis on a random local port, holding the values.
+func startFakeTrackingRedis(t *testing.T, values map[string]string) *fakeTrackingRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake := &fakeTrackingRedis{listener: listener, values: values, clients: make(map[int64]*fakeTrackingClient)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go fake.serve(conn)
+		}
+	}()
+	return fake
+}
+
+func (fake *fakeTrackingRedis) address() string {
+	return fake.listener.Addr().String()
+}
+
+func (fake *fakeTrackingRedis) serve(conn net.Conn) {
+	fake.mu.Lock()
+	fake.nextID++
+	client := &fakeTrackingClient{id: fake.nextID, conn: conn, writer: newRESPWriter(conn), read: make(map[string]bool)}
+	fake.clients[client.id] = client
+	fake.mu.Unlock()
+
+	defer func() {
+		fake.mu.Lock()
+		delete(fake.clients, client.id)
+		fake.mu.Unlock()
+		conn.Close()
+	}()
+
+	reader := newRESPReader(conn)
+	for {
+		args, err := reader.readCommand(true)
+		if err != nil {
+			return
+		}
+
+		fake.mu.Lock()
+		fake.reply(client, args)
+		client.writer.flush()
+		fake.mu.Unlock()
+	}
+}
+
+// Replies to a command from the client. The caller must hold fake.mu.
+func (fake *fakeTrackingRedis) reply(client *fakeTrackingClient, args []string) {
+	writer := client.writer
+	switch command := strings.ToUpper(strings.Join(args[:minInt(2, len(args))], " ")); {
+	case command == "PING" && client.subscribed:
+		writer.writeArrayHeader(2)
+		writer.writeBulkString("pong")
+		writer.writeBulkString("")
+	case command == "PING":
+		writer.writeSimpleString("PONG")
+	case command == "CLIENT ID":
+		writer.writeInteger(client.id)
+	case command == "CLIENT TRACKING" && strings.ToUpper(args[2]) == "OFF":
+		client.redirect = 0
+		writer.writeSimpleString("OK")
+	case command == "CLIENT TRACKING":
+		redirect, _ := strconv.ParseInt(args[4], 10, 64)
+		if fake.clients[redirect] == nil {
+			writer.writeError("ERR The client ID you want redirect to does not exist")
+			return
+		}
+		client.redirect = redirect
+		for i := 5; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "BCAST":
+				client.bcast = true
+			case "PREFIX":
+				i++
+				client.prefixes = append(client.prefixes, args[i])
+			}
+		}
+		writer.writeSimpleString("OK")
+	case command == "SUBSCRIBE "+strings.ToUpper(trackingChannel):
+		client.subscribed = true
+		writer.writeArrayHeader(3)
+		writer.writeBulkString("subscribe")
+		writer.writeBulkString(trackingChannel)
+		writer.writeInteger(1)
+	case strings.HasPrefix(command, "GET "):
+		if client.redirect != 0 && !client.bcast {
+			client.read[args[1]] = true
+		}
+		if value, ok := fake.values[args[1]]; ok {
+			writer.writeBulkString(value)
+		} else {
+			writer.writeNil()
+		}
+	case strings.HasPrefix(command, "PTTL "):
+		writer.writeInteger(-1)
+	default:
+		writer.writeError("ERR unsupported command " + command)
+	}
+}
+
+// Sets the key, and sends invalidation messages to the connections tracking it, as Redis would.
+func (fake *fakeTrackingRedis) set(key, value string) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	fake.values[key] = value
+	for _, client := range fake.clients {
+		tracked := client.read[key]
+		for _, prefix := range client.prefixes {
+			tracked = tracked || strings.HasPrefix(key, prefix)
+		}
+		if client.bcast && len(client.prefixes) == 0 {
+			tracked = true
+		}
+
+		if target := fake.clients[client.redirect]; tracked && client.redirect != 0 && target != nil {
+			delete(client.read, key)
+			target.writer.writeArrayHeader(3)
+			target.writer.writeBulkString("message")
+			target.writer.writeBulkString(trackingChannel)
+			target.writer.writeArrayHeader(1)
+			target.writer.writeBulkString(key)
+			target.writer.flush()
+		}
+	}
+}
+
+// Sends the null invalidation message Redis sends when the database is flushed, to every subscribed connection.
+func (fake *fakeTrackingRedis) flushAll() {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	for _, client := range fake.clients {
+		if client.subscribed {
+			client.writer.writeArrayHeader(3)
+			client.writer.writeBulkString("message")
+			client.writer.writeBulkString(trackingChannel)
+			client.writer.writeNil()
+			client.writer.flush()
+		}
+	}
+}
+
+// Returns the subscribed connection, once there is one. Also fails if the connection is still the one given.
+func (fake *fakeTrackingRedis) waitForSubscriber(t *testing.T, previous *fakeTrackingClient) *fakeTrackingClient {
+	deadline := time.Now().Add(3 * invalidationRetryInterval)
+	for time.Now().Before(deadline) {
+		fake.mu.Lock()
+		for _, client := range fake.clients {
+			if client.subscribed && client != previous {
+				fake.mu.Unlock()
+				return client
+			}
+		}
+		fake.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("Expected the invalidation listener to subscribe")
+	return nil
+}
+
+// Helper function that waits up to a second for the key to be removed from the cache.
+func waitUntilDropped(cache *cache, key string) bool {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if _, status := cache.fetchFromCache(key); status == statusMiss {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+// Checks that keys read through tracked connections are removed from the cache when Redis reports them changed.
+func TestClientTrackingRemovesChangedKeys(t *testing.T) {
+	fake := startFakeTrackingRedis(t, map[string]string{"k": "old", "other": "v"})
+	defer fake.listener.Close()
+	cache := NewCache(fake.address(), 10, 60, maxConnections, WithInvalidation(newClientTracking(false, nil)))
+	defer cache.Close()
+	fake.waitForSubscriber(t, nil)
+
+	cache.get("k")
+	cache.get("other")
+	fake.set("k", "new")
+	if !waitUntilDropped(cache, "k") {
+		t.Fatalf("Expected the changed key to be removed from the cache")
+	}
+	if !cacheHolds(cache, "other", "v") {
+		t.Errorf("Expected other keys to stay cached")
+	}
+	if value, _, _ := cache.get("k"); value != "new" {
+		t.Errorf("Expected the new value to be fetched, got %q", value)
+	}
+
+	fake.flushAll()
+	if !waitUntilDropped(cache, "other") {
+		t.Errorf("Expected the cache to be emptied when Redis is flushed")
+	}
+}
+
+// Checks that in broadcast mode, only the listener's connection is tracked, for the prefixes.
+func TestClientTrackingBroadcastsPrefixes(t *testing.T) {
+	fake := startFakeTrackingRedis(t, map[string]string{"user:1": "old", "feed:1": "old"})
+	defer fake.listener.Close()
+	cache := NewCache(fake.address(), 10, 60, maxConnections,
+		WithInvalidation(newClientTracking(true, []string{"user:"})))
+	defer cache.Close()
+	subscriber := fake.waitForSubscriber(t, nil)
+
+	fake.mu.Lock()
+	if !subscriber.bcast || subscriber.redirect != subscriber.id || strings.Join(subscriber.prefixes, ",") != "user:" {
+		t.Errorf("Expected broadcast tracking of the prefixes, redirected to the listener's own connection")
+	}
+	fake.mu.Unlock()
+
+	cache.get("user:1")
+	cache.get("feed:1")
+	fake.set("user:1", "new")
+	fake.set("feed:1", "new")
+	if !waitUntilDropped(cache, "user:1") {
+		t.Errorf("Expected the key with a tracked prefix to be removed from the cache")
+	}
+	if !cacheHolds(cache, "feed:1", "old") {
+		t.Errorf("Expected the key without a tracked prefix to stay cached")
+	}
+}
+
+// Checks that when the listener resubscribes, the cache is emptied, and pool connections tracked for the old
+// subscription are replaced by ones tracked for the new one.
+func TestClientTrackingResubscribes(t *testing.T) {
+	fake := startFakeTrackingRedis(t, map[string]string{"k": "v1"})
+	defer fake.listener.Close()
+	cache := NewCache(fake.address(), 10, 60, maxConnections, WithInvalidation(newClientTracking(false, nil)))
+	defer cache.Close()
+	subscriber := fake.waitForSubscriber(t, nil)
+
+	cache.get("k")
+	subscriber.conn.Close()
+	fake.waitForSubscriber(t, subscriber)
+	if !waitUntilDropped(cache, "k") {
+		t.Fatalf("Expected the cache to be emptied once resubscribed")
+	}
+
+	cache.get("k")
+	fake.set("k", "v2")
+	if !waitUntilDropped(cache, "k") {
+		t.Errorf("Expected keys read after resubscribing to be tracked")
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"github.com/gomodule/redigo/redis"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+/**
+Writes go through the proxy to Redis, so that services need no separate Redis connection for them, and the cache never
+serves a value older than a write made through it. Once Redis acknowledges a SET, the key's entry is replaced with the
+written value, and once it acknowledges a DEL, the key's entry is removed. Other proxies are then told of the write
+over the invalidation bus, if there is one (see invalidationbus.go). A fetch from Redis of the key that was in flight
+during the write does not cache the value it fetched, and two writes of the same key that overlap leave it uncached,
+since the order in which Redis applied them is unknown.
+ */
+
+// Largest value accepted by PUT requests, as in Redis.
+const maxValueBodyBytes = 512 << 20
+
+// Options of a SET, as in the Redis command: an expiry, and whether to only set keys that don't exist (nx), or that
+// do (xx).
+type setOptions struct {
+	ttl    time.Duration
+	nx, xx bool
+}
+
+// Writes the value to Redis, and caches it. Returns false if the key was not set because of the NX or XX option. In
+// write-behind mode, unconditional writes are cached right away and written to Redis later, see writebehind.go.
+func (cache *cache) set(key, value string, options setOptions) (bool, error) {
+	if cache.writeBehind == nil {
+		return cache.setThrough(key, value, options)
+	}
+
+	if !options.nx && !options.xx {
+		shard := cache.shardFor(key)
+		version := shard.begin(key)
+		if err := cache.writeBehind.enqueue(key, value, options.ttl); err != nil {
+			shard.abandon(key)
+			return false, err
+		}
+		shard.write(key, cache.writtenNode(key, value, options), version)
+		return true, nil
+	}
+
+	var set bool
+	var err error
+	if flushErr := cache.writeBehind.writeDirectly([]string{key}, func() {
+		set, err = cache.setThrough(key, value, options)
+	}); flushErr != nil {
+		return false, flushErr
+	}
+	return set, err
+}
+
+// Writes the value to Redis, and caches it once Redis has acknowledged it.
+func (cache *cache) setThrough(key, value string, options setOptions) (bool, error) {
+	args := redis.Args{key, value}
+	if options.ttl > 0 {
+		args = args.Add("PX", int64(options.ttl/time.Millisecond))
+	}
+	if options.nx {
+		args = args.Add("NX")
+	}
+	if options.xx {
+		args = args.Add("XX")
+	}
+
+	shard := cache.shardFor(key)
+	version := shard.begin(key)
+	conn := cache.pool.Get()
+	_, err := redis.String(conn.Do("SET", args...))
+	conn.Close()
+	if err == redis.ErrNil {
+		shard.abandon(key)
+		return false, nil
+	}
+	if err != nil {
+		// The write may or may not have been applied.
+		shard.write(key, nil, version)
+		cache.publishInvalidation([]string{key})
+		return false, err
+	}
+
+	shard.write(key, cache.writtenNode(key, value, options), version)
+	cache.publishInvalidation([]string{key})
+	return true, nil
+}
+
+// Returns the node caching a value just written to the key, or nil if it should not be cached.
+func (cache *cache) writtenNode(key, value string, options setOptions) *node {
+	pttl := int64(-1)
+	if options.ttl > 0 {
+		pttl = int64(options.ttl / time.Millisecond)
+	}
+
+	ttl, cacheable := cache.ttlFor(key, pttl)
+	if !cacheable {
+		return nil
+	}
+
+	n := cache.valueNodeFor(key, value, ttl)
+	if n != nil {
+		n.written = true
+	}
+	return n
+}
+
+// Deletes the keys from Redis and the cache. Returns the number of keys that existed in Redis. In write-behind mode,
+// pending writes of the keys are flushed first.
+func (cache *cache) del(keys []string) (int, error) {
+	if cache.writeBehind == nil {
+		return cache.delThrough(keys)
+	}
+
+	var deleted int
+	var err error
+	if flushErr := cache.writeBehind.writeDirectly(keys, func() {
+		deleted, err = cache.delThrough(keys)
+	}); flushErr != nil {
+		return 0, flushErr
+	}
+	return deleted, err
+}
+
+func (cache *cache) delThrough(keys []string) (int, error) {
+	versions := make([]uint64, len(keys))
+	for i, key := range keys {
+		versions[i] = cache.shardFor(key).begin(key)
+	}
+
+	conn := cache.pool.Get()
+	deleted, err := redis.Int(conn.Do("DEL", redis.Args{}.AddFlat(keys)...))
+	conn.Close()
+
+	// Even if the reply was lost, the keys may have been deleted.
+	for i, key := range keys {
+		cache.shardFor(key).write(key, nil, versions[i])
+	}
+	cache.publishInvalidation(keys)
+	return deleted, err
+}
+
+// Handles PUT requests, which set the key to the request body. The query may hold ex=<seconds> or px=<milliseconds>
+// to expire the key, and nx or xx to only set it if it does not or does exist. Responds with 204 No Content once
+// written, and 412 Precondition Failed if NX or XX kept the key from being set.
+func (cache *cache) SetValue(w http.ResponseWriter, r *http.Request) {
+	key, err := requestKey(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if key == "" {
+		http.Error(w, "missing key", http.StatusBadRequest)
+		return
+	}
+
+	options, err := parseSetQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	value, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxValueBodyBytes))
+	if err != nil {
+		http.Error(w, "value too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	set, err := cache.set(key, string(value), options)
+	switch {
+	case err != nil:
+		http.Error(w, err.Error(), backendErrorStatus(err))
+	case !set:
+		http.Error(w, "key not set", http.StatusPreconditionFailed)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Handles DELETE requests, which delete the key. Responds with 204 No Content if the key existed, and 404 otherwise.
+func (cache *cache) DeleteValue(w http.ResponseWriter, r *http.Request) {
+	key, err := requestKey(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if key == "" {
+		http.Error(w, "missing key", http.StatusBadRequest)
+		return
+	}
+
+	deleted, err := cache.del([]string{key})
+	switch {
+	case err != nil:
+		http.Error(w, err.Error(), backendErrorStatus(err))
+	case deleted == 0:
+		http.Error(w, "key not found", http.StatusNotFound)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Reads the SET options from the query of a PUT request.
+func parseSetQuery(r *http.Request) (setOptions, error) {
+	var options setOptions
+	query := r.URL.Query()
+	_, options.nx = query["nx"]
+	_, options.xx = query["xx"]
+
+	ex, px := query.Get("ex"), query.Get("px")
+	if (options.nx && options.xx) || (ex != "" && px != "") {
+		return options, errors.New("nx and xx, and ex and px, cannot be combined")
+	}
+
+	var err error
+	if ex != "" {
+		options.ttl, err = parseExpiry(ex, time.Second)
+	} else if px != "" {
+		options.ttl, err = parseExpiry(px, time.Millisecond)
+	}
+	return options, err
+}
+
+// Parses a positive expiry, counted in units.
+func parseExpiry(raw string, unit time.Duration) (time.Duration, error) {
+	n, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || n <= 0 || n > int64(1<<62/unit) {
+		return 0, errors.New("invalid expire time")
+	}
+	return time.Duration(n) * unit, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Checks that PUT writes the value to Redis and caches it, honoring the expiry and NX/XX options.
+func TestSetValueWritesThroughToRedis(t *testing.T) {
+	cache := NewCache(redisServer, 10, 60, maxConnections)
+	defer cache.Close()
+	redisDirect.Do("DEL", "write:k", "write:missing")
+	cache.putInCache("write:k", "cached")
+
+	if res := routeRequest(cache, "PUT", "/keys/write:k?ex=100", "new"); res.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204 but got %d %s", res.Code, res.Body.String())
+	}
+
+	if value, _ := redis.String(redisDirect.Do("GET", "write:k")); value != "new" {
+		t.Errorf("Expected the value to be written to Redis, got %q", value)
+	}
+	if ttl, _ := redis.Int(redisDirect.Do("TTL", "write:k")); ttl <= 60 || ttl > 100 {
+		t.Errorf("Expected a TTL of about 100 seconds in Redis, got %d", ttl)
+	}
+	if !cacheHolds(cache, "write:k", "new") {
+		t.Errorf("Expected the written value to replace the cached one")
+	}
+
+	if res := routeRequest(cache, "PUT", "/keys/write:k?nx", "newer"); res.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 for NX on an existing key, got %d", res.Code)
+	}
+	if res := routeRequest(cache, "PUT", "/keys/write:missing?xx", "v"); res.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 for XX on a missing key, got %d", res.Code)
+	}
+	if !cacheHolds(cache, "write:k", "new") {
+		t.Errorf("Expected a write prevented by NX to leave the cache alone")
+	}
+
+	for _, query := range []string{"?ex=0", "?px=abc", "?ex=1&px=1", "?nx&xx"} {
+		if res := routeRequest(cache, "PUT", "/keys/write:k"+query, "v"); res.Code != http.StatusBadRequest {
+			t.Errorf("For %s, expected 400 but got %d", query, res.Code)
+		}
+	}
+}
+
+// Checks that DELETE removes the key from Redis and the cache, and reports keys that did not exist.
+func TestDeleteValueDeletesFromRedisAndCache(t *testing.T) {
+	cache := NewCache(redisServer, 10, 60, maxConnections)
+	defer cache.Close()
+	redisDirect.Do("SET", "write:del", "v")
+	cache.get("write:del")
+
+	if res := routeRequest(cache, "DELETE", "/keys/write:del", ""); res.Code != http.StatusNoContent {
+		t.Errorf("Expected 204 but got %d", res.Code)
+	}
+	if _, status := cache.fetchFromCache("write:del"); status != statusMiss {
+		t.Errorf("Expected the deleted key to be gone from the cache, got %v", status)
+	}
+	if exists, _ := redis.Int(redisDirect.Do("EXISTS", "write:del")); exists != 0 {
+		t.Errorf("Expected the key to be deleted from Redis")
+	}
+
+	if res := routeRequest(cache, "DELETE", "/keys/write:del", ""); res.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a key that did not exist, got %d", res.Code)
+	}
+}
+
+// Checks that a fetch that was in flight during a write does not cache what it fetched, and that concurrent writes
+// leave the key uncached.
+func TestShardWritesWinOverConcurrentFills(t *testing.T) {
+	shard := newPolicyTestCache(10, newLRUPolicy).shards[0]
+
+	fetchStarted := shard.begin(k1)
+	shard.write(k1, newNode(k1, "written", time.Hour, valuesSegment), shard.begin(k1))
+	shard.fill(k1, newNode(k1, "fetched before the write", time.Hour, valuesSegment), fetchStarted)
+	if value, status, _ := shard.fetch(k1); status != statusHit || value != "written" {
+		t.Errorf("Expected the written value to be kept, got %q %v", value, status)
+	}
+
+	firstStarted := shard.begin(k1)
+	secondStarted := shard.begin(k1)
+	shard.write(k1, newNode(k1, "first", time.Hour, valuesSegment), firstStarted)
+	shard.write(k1, newNode(k1, "second", time.Hour, valuesSegment), secondStarted)
+	if _, status, _ := shard.fetch(k1); status != statusMiss {
+		t.Errorf("Expected concurrent writes to leave the key uncached, got %v", status)
+	}
+	if len(shard.inFlight) != 0 {
+		t.Errorf("Expected no fetches or writes to be left in flight, got %d keys", len(shard.inFlight))
+	}
+}
+
+// Checks that writes and invalidations of other keys in the shard don't keep a fetch from caching what it fetched.
+func TestShardWritesOfOtherKeysLeaveFillsAlone(t *testing.T) {
+	shard := newPolicyTestCache(10, newLRUPolicy).shards[0]
+
+	fetchStarted := shard.begin(k1)
+	shard.write(k2, newNode(k2, "written", time.Hour, valuesSegment), shard.begin(k2))
+	shard.invalidate(k3)
+	shard.fill(k1, newNode(k1, "fetched", time.Hour, valuesSegment), fetchStarted)
+	if value, status, _ := shard.fetch(k1); status != statusHit || value != "fetched" {
+		t.Errorf("Expected the fetched value to be cached, got %q %v", value, status)
+	}
+
+	firstStarted := shard.begin(k1)
+	secondStarted := shard.begin(k2)
+	shard.write(k1, newNode(k1, "first", time.Hour, valuesSegment), firstStarted)
+	shard.write(k2, newNode(k2, "second", time.Hour, valuesSegment), secondStarted)
+	if !cacheHoldsKey(shard, k1) || !cacheHoldsKey(shard, k2) {
+		t.Errorf("Expected concurrent writes of different keys to both be cached")
+	}
+}
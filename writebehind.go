@@ -0,0 +1,330 @@
+package main
+
+import (
+	"errors"
+	"github.com/gomodule/redigo/redis"
+	"log"
+	"sync"
+	"time"
+)
+
+/**
+In write-behind mode, SETs are accepted into the cache right away and written to Redis later, in pipelined batches, for
+high volume writes such as counters and last-seen timestamps where the caller need not wait for Redis. Writes to a key
+that is still waiting to be flushed replace the pending value, so a key written a thousand times between flushes costs
+Redis one SET. Until a write is flushed, reads of the key are served the pending value even if its cache entry was
+evicted. The number of keys waiting is bounded: once the queue is full, writers block until a flush makes room. Close
+flushes everything still pending before returning.
+
+Writes whose outcome depends on Redis, SETs with NX or XX and DELs, still go straight to Redis, once any pending writes
+of their keys have been flushed.
+ */
+
+var errWriteBehindClosed = errors.New("write-behind queue closed")
+
+// A write waiting to be flushed to Redis. seq orders writes, so that a flush can tell whether the key was written again
+// meanwhile. queued tells whether the key is in the flush queue.
+type pendingWrite struct {
+	value     string
+	expiresAt time.Time // Zero if the key does not expire.
+	seq       uint64
+	queued    bool
+}
+
+type writeBehind struct {
+	pool       *redis.Pool
+	flushed    func(keys []string) // Called with the keys of each batch written to Redis.
+	maxPending int
+	batchSize  int
+	interval   time.Duration
+
+	mu      sync.Mutex
+	room    *sync.Cond // Signalled when pending writes are flushed or dropped, or the queue is closed.
+	pending map[string]*pendingWrite
+	queue   []string // Keys in the order they were first written since their last flush.
+	seq     uint64
+	closed  bool
+
+	// Held while writing to Redis, so that direct writes are ordered with flushes of the same keys.
+	flushMu sync.Mutex
+	wake    chan struct{}
+	stop    chan struct{}
+	done    sync.WaitGroup
+}
+
+// Buffers SETs and writes them to Redis in the background, up to batchSize per pipelined batch, every interval or as
+// soon as a full batch is waiting. At most maxPending keys wait to be flushed; writers block when the queue is full.
+// An interval of zero writes SETs through to Redis instead.
+func WithWriteBehind(maxPending, batchSize int, interval time.Duration) option {
+	return func(c *cache) {
+		if interval <= 0 {
+			c.writeBehind = nil
+			return
+		}
+
+		if maxPending < 1 {
+			maxPending = 1
+		}
+		if batchSize < 1 {
+			batchSize = 1
+		}
+		c.writeBehind = &writeBehind{maxPending: maxPending, batchSize: batchSize, interval: interval}
+	}
+}
+
+// Starts flushing writes to Redis over the pool in a goroutine, until stopped. flushed is called with the keys of each
+// batch written.
+func (behind *writeBehind) start(pool *redis.Pool, flushed func(keys []string)) {
+	behind.pool = pool
+	behind.flushed = flushed
+	behind.room = sync.NewCond(&behind.mu)
+	behind.pending = make(map[string]*pendingWrite)
+	behind.wake = make(chan struct{}, 1)
+	behind.stop = make(chan struct{})
+
+	behind.done.Add(1)
+	go func() {
+		defer behind.done.Done()
+		ticker := time.NewTicker(behind.interval)
+		defer ticker.Stop()
+
+		// After a failed flush, wait for the next tick to retry, rather than retrying as fast as writers wake us.
+		wake := behind.wake
+		for {
+			select {
+			case <-ticker.C:
+			case <-wake:
+			case <-behind.stop:
+				if left, err := behind.flushAll(); err != nil {
+					log.Printf("Write-behind: %d writes could not be flushed to Redis on close: %v", left, err)
+				}
+				return
+			}
+
+			wake = behind.wake
+			if left, err := behind.flushAll(); err != nil {
+				log.Printf("Write-behind: flushing to Redis failed, %d writes will be retried: %v", left, err)
+				wake = nil
+			}
+		}
+	}()
+}
+
+// Stops accepting writes, flushes all pending ones to Redis, and stops the flushing goroutine.
+func (behind *writeBehind) shutdown() {
+	behind.mu.Lock()
+	alreadyClosed := behind.closed
+	behind.closed = true
+	behind.room.Broadcast()
+	behind.mu.Unlock()
+
+	if !alreadyClosed {
+		close(behind.stop)
+	}
+	behind.done.Wait()
+}
+
+// Accepts a write of the key, to be flushed later, waiting for room in the queue if it is full.
+func (behind *writeBehind) enqueue(key, value string, ttl time.Duration) error {
+	behind.mu.Lock()
+	defer behind.mu.Unlock()
+
+	for !behind.closed && len(behind.pending) >= behind.maxPending && behind.pending[key] == nil {
+		behind.signalFlush()
+		behind.room.Wait()
+	}
+	if behind.closed {
+		return errWriteBehindClosed
+	}
+
+	write, ok := behind.pending[key]
+	if !ok {
+		write = new(pendingWrite)
+		behind.pending[key] = write
+	}
+
+	behind.seq++
+	write.value = value
+	write.seq = behind.seq
+	write.expiresAt = time.Time{}
+	if ttl > 0 {
+		write.expiresAt = time.Now().Add(ttl)
+	}
+
+	if !write.queued {
+		write.queued = true
+		behind.queue = append(behind.queue, key)
+		if len(behind.queue) >= behind.batchSize {
+			behind.signalFlush()
+		}
+	}
+	return nil
+}
+
+// Wakes the flushing goroutine, unless it has already been woken. The caller must hold behind.mu.
+func (behind *writeBehind) signalFlush() {
+	select {
+	case behind.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Returns the value waiting to be written for the key, if any.
+func (behind *writeBehind) lookup(key string) (string, bool) {
+	behind.mu.Lock()
+	defer behind.mu.Unlock()
+
+	write, ok := behind.pending[key]
+	if !ok || (!write.expiresAt.IsZero() && time.Now().After(write.expiresAt)) {
+		return "", false
+	}
+	return write.value, true
+}
+
+// Flushes batches until nothing is queued, or a batch fails. Returns the number of writes left pending, and the
+// error a batch failed with.
+func (behind *writeBehind) flushAll() (int, error) {
+	for {
+		flushed, err := behind.flushBatch()
+		if err != nil || flushed == 0 {
+			behind.mu.Lock()
+			defer behind.mu.Unlock()
+			return len(behind.pending), err
+		}
+	}
+}
+
+// Writes up to batchSize queued writes to Redis in one pipeline. Writes that fail are queued again, to be retried, and
+// the others are done with. Returns the number of writes sent, and the error the first failed write failed with.
+func (behind *writeBehind) flushBatch() (int, error) {
+	behind.flushMu.Lock()
+	defer behind.flushMu.Unlock()
+
+	behind.mu.Lock()
+	var keys []string
+	var writes []pendingWrite
+	for len(behind.queue) > 0 && len(keys) < behind.batchSize {
+		key := behind.queue[0]
+		behind.queue = behind.queue[1:]
+
+		// Keys written directly since they were queued are no longer pending.
+		if write, ok := behind.pending[key]; ok && write.queued {
+			write.queued = false
+			keys = append(keys, key)
+			writes = append(writes, *write)
+		}
+	}
+	behind.mu.Unlock()
+
+	if len(keys) == 0 {
+		return 0, nil
+	}
+
+	errs := behind.send(keys, writes)
+
+	var written []string
+	behind.mu.Lock()
+	for i, key := range keys {
+		if errs[i] == nil {
+			written = append(written, key)
+		}
+
+		write, ok := behind.pending[key]
+		switch {
+		case !ok:
+		case errs[i] == nil && write.seq == writes[i].seq:
+			delete(behind.pending, key)
+		case !write.queued:
+			write.queued = true
+			behind.queue = append(behind.queue, key)
+		}
+	}
+	behind.room.Broadcast()
+	behind.mu.Unlock()
+
+	if len(written) > 0 {
+		behind.flushed(written)
+	}
+	return len(keys), firstError(errs)
+}
+
+// Sends the writes to Redis in one pipeline. Keys whose expiry has already passed are deleted instead. Returns the error
+// each write failed with, or nil for those Redis acknowledged. Redis replies to each command of a pipeline on its own,
+// so one write failing doesn't fail the others, unless the connection itself failed.
+func (behind *writeBehind) send(keys []string, writes []pendingWrite) []error {
+	conn := behind.pool.Get()
+	defer conn.Close()
+
+	now := time.Now()
+	for i, key := range keys {
+		if writes[i].expiresAt.IsZero() {
+			conn.Send("SET", key, writes[i].value)
+		} else if remaining := writes[i].expiresAt.Sub(now); remaining >= time.Millisecond {
+			conn.Send("SET", key, writes[i].value, "PX", int64(remaining/time.Millisecond))
+		} else {
+			conn.Send("DEL", key)
+		}
+	}
+	errs := make([]error, len(keys))
+	if err := conn.Flush(); err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+
+	// Once the connection fails, every reply left to receive fails with it.
+	for i := range keys {
+		_, errs[i] = conn.Receive()
+	}
+	return errs
+}
+
+// Returns the first error that is not nil, if any.
+func firstError(errs []error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Runs a write that goes straight to Redis, after writing any pending writes of the keys to Redis first, so that the
+// two reach Redis in the order they were made.
+func (behind *writeBehind) writeDirectly(keys []string, write func()) error {
+	behind.flushMu.Lock()
+	defer behind.flushMu.Unlock()
+
+	behind.mu.Lock()
+	var flushKeys []string
+	var flushWrites []pendingWrite
+	for _, key := range keys {
+		if pending, ok := behind.pending[key]; ok {
+			flushKeys = append(flushKeys, key)
+			flushWrites = append(flushWrites, *pending)
+		}
+	}
+	behind.mu.Unlock()
+
+	if len(flushKeys) > 0 {
+		errs := behind.send(flushKeys, flushWrites)
+
+		// Writes that failed, and writes made since, are left pending, to be flushed as usual.
+		behind.mu.Lock()
+		for i, key := range flushKeys {
+			if pending, ok := behind.pending[key]; ok && errs[i] == nil && pending.seq == flushWrites[i].seq {
+				delete(behind.pending, key)
+			}
+		}
+		behind.room.Broadcast()
+		behind.mu.Unlock()
+
+		if err := firstError(errs); err != nil {
+			return err
+		}
+	}
+
+	write()
+	return nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Checks that writes are cached right away and flushed to Redis later, with repeated writes to a key coalesced.
+func TestWriteBehindFlushesCoalescedWritesInBackground(t *testing.T) {
+	cache := NewCache(redisServer, 10, 60, maxConnections, WithWriteBehind(100, 10, 50*time.Millisecond))
+	defer cache.Close()
+	redisDirect.Do("DEL", "behind:counter")
+
+	for i := 1; i <= 100; i++ {
+		if set, err := cache.set("behind:counter", fmt.Sprint(i), setOptions{}); !set || err != nil {
+			t.Fatalf("Expected the write to be accepted, got %v (%v)", set, err)
+		}
+	}
+
+	if !cacheHolds(cache, "behind:counter", "100") {
+		t.Errorf("Expected the latest write to be cached right away")
+	}
+	if exists, _ := redis.Int(redisDirect.Do("EXISTS", "behind:counter")); exists != 0 {
+		t.Errorf("Expected the write not to have reached Redis yet")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if value, _ := redis.String(redisDirect.Do("GET", "behind:counter")); value == "100" {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("Expected the latest write to be flushed to Redis")
+}
+
+// Checks that a pending write is served even once its cache entry is gone, and that Close flushes pending writes.
+func TestWriteBehindServesPendingWritesAndFlushesOnClose(t *testing.T) {
+	cache := NewCache(redisServer, 10, 60, maxConnections, WithWriteBehind(100, 10, time.Hour))
+	redisDirect.Do("SET", "behind:k", "old")
+	redisDirect.Do("SET", "behind:ttl", "old")
+
+	cache.set("behind:k", "new", setOptions{})
+	cache.set("behind:ttl", "new", setOptions{ttl: time.Minute})
+	cache.removeKey("behind:k")
+	if value, _, _ := cache.get("behind:k"); value != "new" {
+		t.Errorf("Expected the pending write to be served, got %q", value)
+	}
+
+	cache.Close()
+	if value, _ := redis.String(redisDirect.Do("GET", "behind:k")); value != "new" {
+		t.Errorf("Expected Close to flush the pending write, got %q", value)
+	}
+	if ttl, _ := redis.Int(redisDirect.Do("TTL", "behind:ttl")); ttl <= 0 || ttl > 60 {
+		t.Errorf("Expected the flushed write to keep its expiry, got TTL %d", ttl)
+	}
+
+	if _, err := cache.set("behind:k", "late", setOptions{}); err != errWriteBehindClosed {
+		t.Errorf("Expected writes after Close to be refused, got %v", err)
+	}
+}
+
+// Checks that writers wait while the queue is full, and go ahead once a flush makes room.
+func TestWriteBehindAppliesBackpressure(t *testing.T) {
+	cache := NewCache(redisServer, 10, 60, maxConnections, WithWriteBehind(2, 10, time.Hour))
+	defer cache.Close()
+
+	cache.set("behind:1", "v", setOptions{})
+	cache.set("behind:2", "v", setOptions{})
+	cache.set("behind:1", "v2", setOptions{})
+
+	// Hold off flushes, as a slow Redis would.
+	cache.writeBehind.flushMu.Lock()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	accepted := make(chan struct{})
+	go func() {
+		defer wg.Done()
+		cache.set("behind:3", "v", setOptions{})
+		close(accepted)
+	}()
+
+	select {
+	case <-accepted:
+		t.Fatalf("Expected the write to wait while the queue is full")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	cache.writeBehind.flushMu.Unlock()
+	select {
+	case <-accepted:
+	case <-time.After(time.Second):
+		t.Errorf("Expected the write to be accepted once the queue was flushed")
+	}
+	wg.Wait()
+}
+
+// Checks that conditional SETs and DELs see pending writes, by flushing them first.
+func TestWriteBehindFlushesPendingWritesBeforeDirectWrites(t *testing.T) {
+	cache := NewCache(redisServer, 10, 60, maxConnections, WithWriteBehind(100, 10, time.Hour))
+	defer cache.Close()
+	redisDirect.Do("DEL", "behind:nx", "behind:del")
+
+	cache.set("behind:nx", "pending", setOptions{})
+	if set, err := cache.set("behind:nx", "v", setOptions{nx: true}); set || err != nil {
+		t.Errorf("Expected NX to fail on a key with a pending write, got %v (%v)", set, err)
+	}
+
+	cache.set("behind:del", "pending", setOptions{})
+	if deleted, err := cache.del([]string{"behind:del"}); deleted != 1 || err != nil {
+		t.Errorf("Expected the pending key to be deleted, got %d (%v)", deleted, err)
+	}
+	if value, status, _ := cache.get("behind:del"); status != statusNotFound {
+		t.Errorf("Expected the deleted key not to be found, got %q %v", value, status)
+	}
+}
+
+// A connection that sends a command Redis doesn't know in place of any write of failKey, so that it fails.
+type failingConn struct {
+	redis.Conn
+	failKey string
+}
+
+func (conn *failingConn) Send(cmd string, args ...interface{}) error {
+	if len(args) > 0 && args[0] == conn.failKey {
+		return conn.Conn.Send("NOSUCHCOMMAND")
+	}
+	return conn.Conn.Send(cmd, args...)
+}
+
+// Checks that a write failing in a batch leaves the other writes of the batch done, and is retried on its own.
+func TestWriteBehindRetriesOnlyFailedWrites(t *testing.T) {
+	cache := NewCache(redisServer, 10, 60, maxConnections, WithWriteBehind(100, 10, time.Hour))
+	defer cache.Close()
+	redisDirect.Do("DEL", "behind:ok", "behind:fail")
+
+	pool := &redis.Pool{Dial: func() (redis.Conn, error) {
+		conn, err := redis.Dial("tcp", redisServer)
+		if err != nil {
+			return nil, err
+		}
+		return &failingConn{Conn: conn, failKey: "behind:fail"}, nil
+	}}
+	defer pool.Close()
+	var flushed []string
+	cache.writeBehind.pool = pool
+	cache.writeBehind.flushed = func(keys []string) { flushed = append(flushed, keys...) }
+
+	cache.set("behind:ok", "v", setOptions{})
+	cache.set("behind:fail", "v", setOptions{})
+	if sent, err := cache.writeBehind.flushBatch(); sent != 2 || err == nil {
+		t.Fatalf("Expected a batch of 2 writes to fail in part, got %d (%v)", sent, err)
+	}
+	if value, _ := redis.String(redisDirect.Do("GET", "behind:ok")); value != "v" || len(flushed) != 1 {
+		t.Errorf("Expected the other write to be flushed and reported alone, got %q and %v", value, flushed)
+	}
+	if _, pending := cache.writeBehind.lookup("behind:ok"); pending {
+		t.Errorf("Expected the flushed write not to be pending anymore")
+	}
+	if _, pending := cache.writeBehind.lookup("behind:fail"); !pending {
+		t.Errorf("Expected the failed write to stay pending")
+	}
+
+	cache.writeBehind.pool = cache.pool
+	if sent, err := cache.writeBehind.flushBatch(); sent != 1 || err != nil {
+		t.Errorf("Expected only the failed write to be retried, got %d (%v)", sent, err)
+	}
+	if value, _ := redis.String(redisDirect.Do("GET", "behind:fail")); value != "v" {
+		t.Errorf("Expected the retried write to reach Redis, got %q", value)
+	}
+}